@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// RunBackfill runs the backfill command.
+func (e *Exporter) RunBackfill() error {
+	mainlogs, rejectlogs := *backfillMainlogs, *backfillRejectlogs
+	if len(mainlogs) == 0 && len(rejectlogs) == 0 {
+		mainlogs, rejectlogs = rotatedLogs(e.mainlog), rotatedLogs(e.rejectlog)
+	}
+	if *backfillResolution <= 0 {
+		return fmt.Errorf("resolution must be positive")
+	}
+	out := os.Stdout
+	if *backfillOutput != "-" {
+		fh, err := os.Create(*backfillOutput)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = fh.Close() }()
+		out = fh
+	}
+	writer := bufio.NewWriter(out)
+	if err := e.Backfill(mainlogs, rejectlogs, *backfillResolution, writer); err != nil {
+		return err
+	}
+	return writer.Flush()
+}
+
+// Backfill reads existing logs through the same parsers used when tailing, and writes the resulting counters as
+// OpenMetrics with a sample every resolution, suitable for `promtool tsdb create-blocks-from openmetrics`.
+// Each list of files must be ordered from oldest to newest. The lines are counted separately from the running
+// exporter's counters.
+func (e *Exporter) Backfill(mainlogs, rejectlogs []string, resolution time.Duration, out io.Writer) error {
+	counters := newLogCounters()
+	registry := prometheus.NewRegistry()
+	for _, metric := range []prometheus.Collector{counters.messages, counters.messageErrors, counters.reject} {
+		if err := registry.Register(metric); err != nil {
+			return err
+		}
+	}
+	sources := []*logSource{
+		{files: mainlogs, process: counters.processMainLogLine},
+		{files: rejectlogs, process: func(string) { counters.reject.Inc() }},
+	}
+	for _, source := range sources {
+		source.next(e)
+	}
+
+	samples, err := newBackfillSamples(resolution)
+	if err != nil {
+		return err
+	}
+	defer samples.close()
+	var step time.Time
+	for {
+		// Merge the logs, so every sample reflects all lines logged before it.
+		var source *logSource
+		for _, s := range sources {
+			if s.text != "" && (source == nil || s.time.Before(source.time)) {
+				source = s
+			}
+		}
+		if source == nil {
+			break
+		}
+		if step.IsZero() {
+			step = source.time.Truncate(resolution).Add(resolution)
+		}
+		for !source.time.Before(step) {
+			if err := samples.gather(registry, step); err != nil {
+				return err
+			}
+			step = step.Add(resolution)
+		}
+		source.process(source.text)
+		source.next(e)
+	}
+	if step.IsZero() {
+		return fmt.Errorf("no log lines found")
+	}
+	if err := samples.gather(registry, step); err != nil {
+		return err
+	}
+	return samples.write(out)
+}
+
+// logSource reads timestamped lines from a sequence of log files.
+type logSource struct {
+	files   []string
+	process func(string)
+	reader  *bufio.Reader
+	closer  io.Closer
+	text    string
+	time    time.Time
+}
+
+// next reads the following line into text, or sets it to empty once all files have been read. Lines without a
+// timestamp, like the headers in the rejectlog, are assigned the time of the line before them.
+func (s *logSource) next(e *Exporter) {
+	for {
+		if s.reader == nil {
+			if len(s.files) == 0 {
+				s.text = ""
+				return
+			}
+			filename := s.files[0]
+			s.files = s.files[1:]
+			_ = level.Info(e.logger).Log("msg", "Reading log", "filename", filename)
+			reader, err := openLog(filename)
+			if err != nil {
+				_ = level.Error(e.logger).Log("msg", "Unable to open log", "filename", filename, "err", err)
+				continue
+			}
+			s.reader = bufio.NewReader(reader)
+			s.closer = reader
+		}
+		text, err := s.reader.ReadString('\n')
+		if err != nil {
+			if err != io.EOF {
+				_ = level.Error(e.logger).Log("msg", "Unable to read log", "err", err)
+			}
+			_ = s.closer.Close()
+			s.reader = nil
+			if text == "" {
+				continue
+			}
+		}
+		text = strings.TrimSuffix(text, "\n")
+		if t, ok := logTimestamp(text); ok {
+			s.time = t
+		}
+		if text != "" && !s.time.IsZero() {
+			s.text = text
+			return
+		}
+	}
+}
+
+// logTimestamp parses the time at the start of an Exim log line, including the timezone if log_timezone is set.
+func logTimestamp(text string) (time.Time, bool) {
+	parts := strings.SplitN(text, " ", 4)
+	if len(parts) < 2 {
+		return time.Time{}, false
+	}
+	if len(parts) > 2 && len(parts[2]) == 5 && (parts[2][0] == '+' || parts[2][0] == '-') {
+		if t, err := time.Parse("2006-01-02 15:04:05 -0700", strings.Join(parts[:3], " ")); err == nil {
+			return t, true
+		}
+	}
+	t, err := time.ParseInLocation("2006-01-02 15:04:05", parts[0]+" "+parts[1], time.Local)
+	return t, err == nil
+}
+
+// How many bytes of samples are held in memory for each series before they are appended to its file.
+const backfillBufferSize = 64 * 1024
+
+// backfillSamples collects the samples of each series. OpenMetrics requires the samples of each series to be grouped
+// together, while they are gathered a step at a time, so they are kept in a temporary file per series until the end,
+// rather than holding the whole history in memory.
+type backfillSamples struct {
+	dir        string
+	headers    map[string][]byte
+	series     map[string]*backfillSeries
+	resolution time.Duration
+	rendered   bytes.Buffer
+}
+
+type backfillSeries struct {
+	family    string
+	signature string
+	filename  string
+	buffer    bytes.Buffer
+}
+
+func newBackfillSamples(resolution time.Duration) (*backfillSamples, error) {
+	dir, err := os.MkdirTemp("", "exim_exporter_backfill")
+	if err != nil {
+		return nil, err
+	}
+	return &backfillSamples{
+		dir:        dir,
+		headers:    make(map[string][]byte),
+		series:     make(map[string]*backfillSeries),
+		resolution: resolution,
+	}, nil
+}
+
+// close removes the temporary files.
+func (b *backfillSamples) close() {
+	_ = os.RemoveAll(b.dir)
+}
+
+// gather records the current value of each counter with the given timestamp. Counters are only exported once they
+// have been incremented, so a zero sample is added one step before the first value, for rate() to see the increase.
+func (b *backfillSamples) gather(registry *prometheus.Registry, timestamp time.Time) error {
+	families, err := registry.Gather()
+	if err != nil {
+		return err
+	}
+	ms := timestamp.UnixMilli()
+	for _, family := range families {
+		name := family.GetName()
+		for _, metric := range family.Metric {
+			key := name + labelSignature(metric)
+			series, ok := b.series[key]
+			if !ok {
+				series = &backfillSeries{
+					family:    name,
+					signature: labelSignature(metric),
+					filename:  filepath.Join(b.dir, strconv.Itoa(len(b.series))),
+				}
+				b.series[key] = series
+				zero, previous := float64(0), ms-b.resolution.Milliseconds()
+				if err := b.add(series, family, &dto.Metric{
+					Label:       metric.Label,
+					Counter:     &dto.Counter{Value: &zero},
+					TimestampMs: &previous,
+				}); err != nil {
+					return err
+				}
+			}
+			metric.TimestampMs = &ms
+			if err := b.add(series, family, metric); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// add renders a sample of the series, keeping the HELP and TYPE lines of its family aside to write once.
+func (b *backfillSamples) add(series *backfillSeries, family *dto.MetricFamily, metric *dto.Metric) error {
+	b.rendered.Reset()
+	sample := &dto.MetricFamily{Name: family.Name, Help: family.Help, Type: family.Type, Metric: []*dto.Metric{metric}}
+	if _, err := expfmt.MetricFamilyToOpenMetrics(&b.rendered, sample); err != nil {
+		return err
+	}
+	_, seen := b.headers[series.family]
+	for b.rendered.Len() > 0 {
+		line, _ := b.rendered.ReadBytes('\n')
+		if line[0] != '#' {
+			series.buffer.Write(line)
+		} else if !seen {
+			b.headers[series.family] = append(b.headers[series.family], line...)
+		}
+	}
+	if series.buffer.Len() >= backfillBufferSize {
+		return series.flush()
+	}
+	return nil
+}
+
+// flush appends the buffered samples to the series' file.
+func (s *backfillSeries) flush() error {
+	fh, err := os.OpenFile(s.filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := s.buffer.WriteTo(fh); err != nil {
+		_ = fh.Close()
+		return err
+	}
+	return fh.Close()
+}
+
+func (b *backfillSamples) write(out io.Writer) error {
+	series := make([]*backfillSeries, 0, len(b.series))
+	for _, s := range b.series {
+		series = append(series, s)
+	}
+	sort.Slice(series, func(i, j int) bool {
+		if series[i].family != series[j].family {
+			return series[i].family < series[j].family
+		}
+		return series[i].signature < series[j].signature
+	})
+	for i, s := range series {
+		if i == 0 || s.family != series[i-1].family {
+			if _, err := out.Write(b.headers[s.family]); err != nil {
+				return err
+			}
+		}
+		if err := s.flush(); err != nil {
+			return err
+		}
+		fh, err := os.Open(s.filename)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(out, fh)
+		_ = fh.Close()
+		if err != nil {
+			return err
+		}
+	}
+	_, err := expfmt.FinalizeOpenMetrics(out)
+	return err
+}
+
+func labelSignature(metric *dto.Metric) string {
+	var signature strings.Builder
+	for _, pair := range metric.Label {
+		signature.WriteString("\xff" + pair.GetName() + "\xff" + pair.GetValue())
+	}
+	return signature.String()
+}
+
+// rotatedLogs returns the log file and its rotated copies (mainlog.1, mainlog.2.gz, etc), oldest first.
+// For datestamped logs, every file matching the template is returned in date order.
+func rotatedLogs(filename string) []string {
+	if isDatestamped(filename) {
+		matches, _ := filepath.Glob(strings.NewReplacer("%D", "*", "%M", "*").Replace(filename))
+		sort.Strings(matches)
+		return matches
+	}
+	matches, _ := filepath.Glob(filename + ".*")
+	rotated := make(map[string]int)
+	for _, match := range matches {
+		suffix := strings.SplitN(strings.TrimPrefix(match, filename+"."), ".", 2)[0]
+		if n, err := strconv.Atoi(suffix); err == nil {
+			rotated[match] = n
+		}
+	}
+	logs := make([]string, 0, len(rotated)+1)
+	for match := range rotated {
+		logs = append(logs, match)
+	}
+	sort.Slice(logs, func(i, j int) bool { return rotated[logs[i]] > rotated[logs[j]] })
+	if _, err := os.Stat(filename); err == nil {
+		logs = append(logs, filename)
+	}
+	return logs
+}
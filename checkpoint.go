@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/nxadm/tail"
+)
+
+// Checkpoint records how far each log has been read, so tailing can resume where it left off after a restart.
+// A nil *Checkpoint is valid and disables checkpointing.
+type Checkpoint struct {
+	filename string
+	logger   log.Logger
+	mu       sync.Mutex
+	Files    map[string]*FilePosition `json:"files"`
+	Journal  map[string]string        `json:"journal"`
+}
+
+// FilePosition identifies the last line read from a log file.
+type FilePosition struct {
+	Filename string `json:"filename"`
+	Inode    uint64 `json:"inode"`
+	Offset   int64  `json:"offset"`
+	// A hash of the start of the file, to recognise it once logrotate has compressed it into a new file.
+	Fingerprint     string `json:"fingerprint,omitempty"`
+	FingerprintSize int64  `json:"fingerprint_size,omitempty"`
+}
+
+// How much of the start of a log is hashed to recognise it after compression.
+const fingerprintSize = 1024
+
+// updateFingerprint hashes the start of the file once more of it has been read, up to fingerprintSize bytes.
+func (pos *FilePosition) updateFingerprint() {
+	size := min(pos.Offset, fingerprintSize)
+	if size <= pos.FingerprintSize {
+		return
+	}
+	if sum := fingerprint(pos.Filename, size); sum != "" {
+		pos.Fingerprint, pos.FingerprintSize = sum, size
+	}
+}
+
+// fingerprint returns the hash of the first size bytes of the log, decompressing it if needed, or "" if it is shorter.
+func fingerprint(filename string, size int64) string {
+	fh, err := openLog(filename)
+	if err != nil {
+		return ""
+	}
+	defer func() { _ = fh.Close() }()
+	hash := sha256.New()
+	if _, err := io.CopyN(hash, fh, size); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func LoadCheckpoint(filename string, logger log.Logger) *Checkpoint {
+	c := &Checkpoint{
+		filename: filename,
+		logger:   logger,
+		Files:    make(map[string]*FilePosition),
+		Journal:  make(map[string]string),
+	}
+	data, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return c
+	} else if err != nil {
+		_ = level.Warn(logger).Log("msg", "Unable to read checkpoint file, starting from the end of the logs", "err", err)
+		return c
+	}
+	if err := json.Unmarshal(data, c); err != nil {
+		_ = level.Warn(logger).Log("msg", "Unable to parse checkpoint file, starting from the end of the logs", "err", err)
+		c.Files = make(map[string]*FilePosition)
+		c.Journal = make(map[string]string)
+	}
+	if c.Files == nil {
+		c.Files = make(map[string]*FilePosition)
+	}
+	if c.Journal == nil {
+		c.Journal = make(map[string]string)
+	}
+	return c
+}
+
+// checkpointPositions is a copy of the positions held by a checkpoint.
+type checkpointPositions struct {
+	Files   map[string]*FilePosition `json:"files"`
+	Journal map[string]string        `json:"journal"`
+}
+
+// positions copies the current positions. The caller must hold c.mu.
+func (c *Checkpoint) positions() *checkpointPositions {
+	positions := &checkpointPositions{
+		Files:   make(map[string]*FilePosition, len(c.Files)),
+		Journal: make(map[string]string, len(c.Journal)),
+	}
+	for key, pos := range c.Files {
+		copied := *pos
+		positions.Files[key] = &copied
+	}
+	for key, cursor := range c.Journal {
+		positions.Journal[key] = cursor
+	}
+	return positions
+}
+
+// restorePositions replaces the positions with ones saved in the state file.
+func (c *Checkpoint) restorePositions(positions *checkpointPositions) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Files = make(map[string]*FilePosition)
+	c.Journal = make(map[string]string)
+	for key, pos := range positions.Files {
+		copied := *pos
+		c.Files[key] = &copied
+	}
+	for key, cursor := range positions.Journal {
+		c.Journal[key] = cursor
+	}
+}
+
+// Run saves the checkpoint every interval.
+func (c *Checkpoint) Run(interval time.Duration) {
+	if c == nil {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		c.Save()
+	}
+}
+
+func (c *Checkpoint) Save() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	data, err := json.Marshal(c)
+	c.mu.Unlock()
+	if err != nil {
+		_ = level.Error(c.logger).Log("msg", "Unable to encode checkpoint", "err", err)
+		return
+	}
+	// Write to a temporary file first, so a crash never leaves a truncated checkpoint behind.
+	tmp := c.filename + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		_ = level.Error(c.logger).Log("msg", "Unable to write checkpoint", "err", err)
+		return
+	}
+	if err := os.Rename(tmp, c.filename); err != nil {
+		_ = level.Error(c.logger).Log("msg", "Unable to write checkpoint", "err", err)
+	}
+}
+
+func (c *Checkpoint) Position(key string) *FilePosition {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if pos, ok := c.Files[key]; ok {
+		copied := *pos
+		return &copied
+	}
+	return nil
+}
+
+// Update records the offset of the last line read from filename. A new file or an offset going backwards means the
+// file was switched or reopened after rotation, so the inode is looked up again.
+func (c *Checkpoint) Update(key, filename string, offset int64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pos, ok := c.Files[key]
+	if !ok || pos.Filename != filename || offset < pos.Offset {
+		pos = &FilePosition{Filename: filename, Inode: inode(filename)}
+		c.Files[key] = pos
+	}
+	pos.Offset = offset
+	pos.updateFingerprint()
+}
+
+// Start records the position reading of filename begins at.
+func (c *Checkpoint) Start(key, filename string, offset int64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pos := &FilePosition{Filename: filename, Inode: inode(filename), Offset: offset}
+	pos.updateFingerprint()
+	c.Files[key] = pos
+}
+
+func (c *Checkpoint) Cursor(key string) string {
+	if c == nil {
+		return ""
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Journal[key]
+}
+
+func (c *Checkpoint) UpdateCursor(key, cursor string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Journal[key] = cursor
+}
+
+func inode(filename string) uint64 {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return 0
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return stat.Ino
+	}
+	return 0
+}
+
+// resumeLog replays anything written to the log since the last checkpoint and returns the location to start tailing
+// the current file from. If the checkpointed file has since been rotated (or replaced by the next datestamped file),
+// the rest of it is read first, provided it can still be found by inode, or by fingerprint once it was compressed.
+func (e *Exporter) resumeLog(key, current string, lines chan *tail.Line) *tail.SeekInfo {
+	end := &tail.SeekInfo{Whence: io.SeekEnd}
+	if _, err := os.Stat(current); os.IsNotExist(err) {
+		// The file hasn't been created yet, so read it from the start once it appears.
+		end = nil
+	}
+	pos := e.checkpoint.Position(key)
+	if pos == nil || pos.Inode == 0 {
+		return end
+	}
+	size := fileSize(current)
+	if pos.Filename == current && pos.Inode == inode(current) {
+		if pos.Offset > size {
+			_ = level.Warn(e.logger).Log("msg", "Log was truncated since the last checkpoint, reading from the start", "filename", current)
+			return e.replayStart(current, 0, size)
+		}
+		return e.replayStart(current, pos.Offset, size)
+	}
+	previous := findRotatedLog(pos, current)
+	if previous == "" {
+		_ = level.Warn(e.logger).Log("msg", "Unable to find the checkpointed log, lines may have been missed", "filename", pos.Filename)
+	} else {
+		e.replayFile(key, previous, pos.Offset, lines)
+	}
+	if end == nil {
+		return nil
+	}
+	return e.replayStart(current, 0, size)
+}
+
+// findRotatedLog looks for the checkpointed file after it was rotated away from current. Renamed logs keep their inode,
+// but compressing one writes a new file, such as mainlog.1.gz, mainlog-20240214.gz or mainlog-20240214.zst, which is
+// matched by the start of its contents instead.
+func findRotatedLog(pos *FilePosition, current string) string {
+	for _, candidate := range []string{pos.Filename, current + ".0", current + ".1"} {
+		if candidate != current && inode(candidate) == pos.Inode {
+			return candidate
+		}
+	}
+	if pos.FingerprintSize == 0 {
+		return ""
+	}
+	seen := make(map[string]bool)
+	for _, pattern := range []string{pos.Filename + ".*", current + ".*", current + "-*"} {
+		candidates, _ := filepath.Glob(pattern)
+		for _, candidate := range candidates {
+			if seen[candidate] || candidate == current {
+				continue
+			}
+			seen[candidate] = true
+			if isCompressedLog(candidate) && fingerprint(candidate, pos.FingerprintSize) == pos.Fingerprint {
+				return candidate
+			}
+		}
+	}
+	return ""
+}
+
+// replayStart limits how much of the backlog in filename is replayed, skipping ahead to a line boundary when the
+// backlog is larger than --tail.checkpoint-max-replay.
+func (e *Exporter) replayStart(filename string, offset, size int64) *tail.SeekInfo {
+	maxReplay := int64(*checkpointMaxReplay)
+	if maxReplay > 0 && size-offset > maxReplay {
+		_ = level.Warn(e.logger).Log("msg", "Skipping log backlog larger than the replay limit", "filename", filename, "bytes", size-offset-maxReplay)
+		offset = alignToLine(filename, size-maxReplay)
+	}
+	if offset > 0 {
+		_ = level.Info(e.logger).Log("msg", "Resuming log from checkpoint", "filename", filename, "offset", offset)
+	}
+	return &tail.SeekInfo{Offset: offset, Whence: io.SeekStart}
+}
+
+// replayFile sends the complete lines of filename from offset onwards.
+func (e *Exporter) replayFile(key, filename string, offset int64, lines chan *tail.Line) {
+	if isCompressedLog(filename) {
+		// The rotated log was compressed since, so its uncompressed size isn't known, and the rest is replayed in full.
+		e.checkpoint.Start(key, filename, offset)
+		e.readRemainder(key, filename, offset, lines)
+		return
+	}
+	size := fileSize(filename)
+	if offset > size {
+		offset = 0
+	}
+	start := e.replayStart(filename, offset, size)
+	e.checkpoint.Start(key, filename, start.Offset)
+	e.readRemainder(key, filename, start.Offset, lines)
+}
+
+// readRemainder sends the complete lines of filename after offset, for a file which is no longer being tailed.
+// Offsets are positions in the uncompressed log, so a log which has been compressed is read up to the offset.
+func (e *Exporter) readRemainder(key, filename string, offset int64, lines chan *tail.Line) {
+	fh, err := openLog(filename)
+	if err != nil {
+		_ = level.Warn(e.logger).Log("msg", "Unable to open previous log, lines may have been missed", "filename", filename, "err", err)
+		return
+	}
+	defer func() { _ = fh.Close() }()
+	if file, ok := fh.(*os.File); ok {
+		_, err = file.Seek(offset, io.SeekStart)
+	} else {
+		_, err = io.CopyN(io.Discard, fh, offset)
+	}
+	if err != nil {
+		_ = level.Warn(e.logger).Log("msg", "Unable to seek previous log, lines may have been missed", "filename", filename, "err", err)
+		return
+	}
+	reader := bufio.NewReader(fh)
+	position := offset
+	for {
+		text, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		position += int64(len(text))
+		lines <- &tail.Line{Text: text[:len(text)-1], SeekInfo: tail.SeekInfo{Offset: position}, Time: time.Now()}
+		e.checkpoint.Update(key, filename, position)
+	}
+}
+
+func fileSize(filename string) int64 {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// alignToLine returns the offset of the first line starting at or after offset.
+func alignToLine(filename string, offset int64) int64 {
+	fh, err := os.Open(filename)
+	if err != nil {
+		return offset
+	}
+	defer func() { _ = fh.Close() }()
+	if offset == 0 {
+		return 0
+	}
+	// Start one byte early, in case offset is already the start of a line.
+	if _, err := fh.Seek(offset-1, io.SeekStart); err != nil {
+		return offset
+	}
+	skipped, err := bufio.NewReader(fh).ReadString('\n')
+	if err != nil {
+		return offset
+	}
+	return offset - 1 + int64(len(skipped))
+}
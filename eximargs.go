@@ -0,0 +1,133 @@
+package main
+
+import (
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Exim options followed by a separate value, which mustn't be mistaken for an option or recipient
+var eximOptionValues = map[string]bool{
+	"-C": true, "-f": true, "-F": true, "-L": true, "-r": true, "-X": true,
+	"-oA": true, "-oMa": true, "-oMaa": true, "-oMai": true, "-oMas": true, "-oMi": true, "-oMm": true, "-oMr": true,
+	"-oMs": true, "-oMt": true, "-oP": true, "-oPX": true,
+}
+
+// The interval of a periodic queue run, as in -q30m or -q1h30m
+var queueIntervalRegexp = regexp.MustCompile(`^([0-9]+[smhdw])+$`)
+
+// The priority of each state, when a command line has options for more than one, highest first in the README's table.
+// A daemon which also runs the queue is a daemon, and a delivery continued over an existing connection is a delivery.
+var processStatePriority = map[string]int{
+	"other":      0,
+	"submitting": 1,
+	"handling":   2,
+	"running":    3,
+	"delivering": 4,
+	"daemon":     5,
+}
+
+// queueRun is a queue run requested on the command line.
+type queueRun struct {
+	queue string
+	// Run every interval, rather than once
+	periodic bool
+	// Only messages with recipients matching the following argument are delivered
+	selective bool
+}
+
+// parseQueueRun parses the option starting a queue run: -q[q][i][f[f]][l][G<name>[/<interval>]][<interval>], or
+// -R and -S (also given as -qR and -qS) for selective runs.
+func parseQueueRun(arg string) (queueRun, bool) {
+	if strings.HasPrefix(arg, "-R") || strings.HasPrefix(arg, "-S") {
+		return queueRun{selective: true}, true
+	}
+	if !strings.HasPrefix(arg, "-q") {
+		return queueRun{}, false
+	}
+	rest := strings.TrimLeft(strings.TrimPrefix(arg, "-q"), "qifl")
+	switch {
+	case rest == "":
+		return queueRun{}, true
+	case strings.HasPrefix(rest, "G"):
+		queue, interval, periodic := strings.Cut(rest[1:], "/")
+		if periodic && !queueIntervalRegexp.MatchString(interval) {
+			return queueRun{}, false
+		}
+		return queueRun{queue: queue, periodic: periodic}, true
+	case strings.HasPrefix(rest, "R") || strings.HasPrefix(rest, "S"):
+		return queueRun{selective: true}, true
+	case queueIntervalRegexp.MatchString(rest):
+		return queueRun{periodic: true}, true
+	}
+	return queueRun{}, false
+}
+
+// parseEximArgs works out what an exim process is doing from its arguments (without the executable), returning its
+// state, and for queue runners, the queue being run. Processes forked by the daemon to handle SMTP connections or run
+// the queue keep the daemon's arguments, so the daemon is told apart by being a process group leader.
+func parseEximArgs(args []string, leader bool) (string, string) {
+	state, queue := "other", ""
+	daemon := slices.Contains(args, "-bd") || slices.Contains(args, "-bdf")
+	set := func(s string) {
+		if processStatePriority[s] > processStatePriority[state] {
+			state = s
+		}
+	}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--":
+			// Everything after is a recipient
+			if i+1 < len(args) {
+				set("submitting")
+			}
+			i = len(args)
+		case eximOptionValues[arg]:
+			i++
+		case arg == "-bd" || arg == "-bdf":
+			if leader {
+				set("daemon")
+			} else {
+				set("handling")
+			}
+		case arg == "-Mc" || arg == "-M" || strings.HasPrefix(arg, "-MC"):
+			// Delivery of the given messages, or a delivery continued over an existing connection by -MC
+			set("delivering")
+		case strings.HasPrefix(arg, "-M"):
+			// Administrative commands, such as -Mrm, followed by message IDs
+			i = len(args)
+		case arg == "-bs":
+			// An SMTP session on stdin, as run from inetd
+			set("handling")
+		case arg == "-bS" || arg == "-bm" || arg == "-t" || arg == "-odf" || arg == "-odi":
+			// Local submissions, from batch SMTP or the command line, delivered in the foreground with -odf and -odi
+			set("submitting")
+		case strings.HasPrefix(arg, "-q") || strings.HasPrefix(arg, "-R") || strings.HasPrefix(arg, "-S"):
+			run, ok := parseQueueRun(arg)
+			if !ok {
+				break
+			}
+			if run.selective {
+				// Skip the string selecting the messages
+				i++
+			}
+			// A periodic queue run without -bd starts a daemon which only runs the queue, forking a runner each time.
+			// Along with -bd, the interval belongs to the daemon, and its children handle SMTP connections.
+			switch {
+			case run.periodic && leader:
+				set("daemon")
+			case !run.periodic || !daemon:
+				set("running")
+			}
+			queue = run.queue
+		case !strings.HasPrefix(arg, "-"):
+			// Recipients given on the command line, as by sendmail
+			set("submitting")
+		}
+	}
+	if state != "running" {
+		queue = ""
+	}
+	return state, queue
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Exim keeps its hints databases in whichever DBM library it was built with. These are the magic numbers identifying
+// the on-disk formats of the ones we can read.
+const (
+	bdbHashMagic        = 0x061561
+	gdbmOMagic          = 0x13579ace
+	gdbmMagic32         = 0x13579acd
+	gdbmMagic64         = 0x13579acf
+	gdbmNumsyncMagic32  = 0x13579ad0
+	gdbmNumsyncMagic64  = 0x13579ad1
+	tdbVersion          = 0x26011967 + 6
+	tdbMagic            = 0x26011999
+	tdbHeaderSize       = 168
+	tdbRecordHeaderSize = 24
+)
+
+// Berkeley DB page and item types
+const (
+	bdbPageHashUnsorted = 2
+	bdbPageOverflow     = 7
+	bdbPageHashMeta     = 8
+	bdbPageHash         = 13
+	bdbPageHeaderSize   = 26
+	bdbItemKeyData      = 1
+	bdbItemOffPage      = 3
+)
+
+var errHintsFormat = errors.New("unsupported hints database format")
+
+// RetryRecord is an entry in the retry hints database, recording when delivery to a host or address started failing
+// and when it will next be tried. The value is Exim's dbdata_retry struct.
+type RetryRecord struct {
+	Key         string
+	Expired     bool
+	BasicErrno  int32
+	MoreErrno   int32
+	FirstFailed time.Time
+	LastTry     time.Time
+	NextTry     time.Time
+	Text        string
+}
+
+// Type returns what the retry record is for: routing to a domain or address (R:), or delivering to a host (T:).
+func (r RetryRecord) Type() string {
+	switch {
+	case strings.HasPrefix(r.Key, "R:"):
+		return "routing"
+	case strings.HasPrefix(r.Key, "T:"):
+		return "transport"
+	}
+	return ""
+}
+
+// parseRetryRecord decodes a dbdata_retry struct, as laid out by a 64-bit build of Exim:
+// time_stamp, basic_errno, more_errno, expired, first_failed, last_try, next_try, text.
+func parseRetryRecord(key, value []byte, order binary.ByteOrder) (RetryRecord, error) {
+	if len(value) < 48 {
+		return RetryRecord{}, fmt.Errorf("retry record %q is %d bytes", key, len(value))
+	}
+	text := value[48:]
+	if i := bytes.IndexByte(text, 0); i >= 0 {
+		text = text[:i]
+	}
+	return RetryRecord{
+		Key:         string(bytes.TrimRight(key, "\x00")),
+		BasicErrno:  int32(order.Uint32(value[8:])),
+		MoreErrno:   int32(order.Uint32(value[12:])),
+		Expired:     order.Uint32(value[16:]) != 0,
+		FirstFailed: time.Unix(int64(order.Uint64(value[24:])), 0),
+		LastTry:     time.Unix(int64(order.Uint64(value[32:])), 0),
+		NextTry:     time.Unix(int64(order.Uint64(value[40:])), 0),
+		Text:        string(text),
+	}, nil
+}
+
+// readHintsDB calls fn with each key and value in a hints database, along with the byte order of the machine which
+// wrote it. The format is detected from the file's magic number.
+func readHintsDB(data []byte, fn func(key, value []byte, order binary.ByteOrder) error) error {
+	if len(data) >= tdbHeaderSize && bytes.HasPrefix(data, []byte("TDB file")) {
+		return readTDB(data, fn)
+	}
+	if len(data) >= 4 {
+		for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+			switch order.Uint32(data) {
+			case gdbmOMagic, gdbmMagic64, gdbmNumsyncMagic64:
+				return readGDBM(data, order, 8, fn)
+			case gdbmMagic32, gdbmNumsyncMagic32:
+				return readGDBM(data, order, 4, fn)
+			}
+		}
+	}
+	if len(data) >= 16 {
+		for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+			if order.Uint32(data[12:]) == bdbHashMagic {
+				return readBDBHash(data, order, fn)
+			}
+		}
+	}
+	return errHintsFormat
+}
+
+// slice returns length bytes of data from offset, or an error if the database is truncated.
+func slice(data []byte, offset, length uint64) ([]byte, error) {
+	if offset > uint64(len(data)) || length > uint64(len(data))-offset {
+		return nil, fmt.Errorf("offset %d length %d beyond end of file", offset, length)
+	}
+	return data[offset : offset+length], nil
+}
+
+// readGDBM walks the buckets of a GDBM database, in the file layout of either 32 or 64-bit file offsets.
+func readGDBM(data []byte, order binary.ByteOrder, offsetSize int, fn func(key, value []byte, order binary.ByteOrder) error) error {
+	readOffset := func(b []byte) uint64 {
+		if offsetSize == 4 {
+			return uint64(order.Uint32(b))
+		}
+		return order.Uint64(b)
+	}
+	// header_magic, block_size, dir, dir_size, dir_bits, bucket_size, bucket_elems
+	header, err := slice(data, 0, uint64(8+offsetSize+16))
+	if err != nil {
+		return err
+	}
+	dirOffset := readOffset(header[8:])
+	dirSize := uint64(order.Uint32(header[8+offsetSize:]))
+	bucketElems := uint64(order.Uint32(header[8+offsetSize+12:]))
+	dir, err := slice(data, dirOffset, dirSize)
+	if err != nil {
+		return err
+	}
+
+	// av_count, bucket_avail[6] of {av_size, av_adr}, bucket_bits, count, then the elements. The avail entries are
+	// aligned to the size of the file offsets.
+	availSize := 2 * offsetSize
+	availStart := offsetSize
+	tableStart := uint64(availStart + 6*availSize + 8)
+	// hash_value, key_start[4], data_pointer, key_size, data_size
+	elemSize := uint64(8 + offsetSize + 8)
+
+	seen := make(map[uint64]bool)
+	for i := 0; i+offsetSize <= len(dir); i += offsetSize {
+		bucketOffset := readOffset(dir[i:])
+		if seen[bucketOffset] {
+			continue
+		}
+		seen[bucketOffset] = true
+		bucket, err := slice(data, bucketOffset, tableStart+bucketElems*elemSize)
+		if err != nil {
+			return err
+		}
+		for j := uint64(0); j < bucketElems; j++ {
+			elem := bucket[tableStart+j*elemSize:]
+			if int32(order.Uint32(elem)) == -1 {
+				continue
+			}
+			dataPointer := readOffset(elem[8:])
+			keySize := uint64(order.Uint32(elem[8+offsetSize:]))
+			dataSize := uint64(order.Uint32(elem[8+offsetSize+4:]))
+			record, err := slice(data, dataPointer, keySize+dataSize)
+			if err != nil {
+				return err
+			}
+			if err := fn(record[:keySize], record[keySize:], order); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readTDB follows the hash chains of a TDB database, skipping deleted records.
+func readTDB(data []byte, fn func(key, value []byte, order binary.ByteOrder) error) error {
+	var order binary.ByteOrder
+	switch {
+	case binary.LittleEndian.Uint32(data[32:]) == tdbVersion:
+		order = binary.LittleEndian
+	case binary.BigEndian.Uint32(data[32:]) == tdbVersion:
+		order = binary.BigEndian
+	default:
+		return errHintsFormat
+	}
+	hashSize := uint64(order.Uint32(data[36:]))
+	// The free list comes first, then the hash chains
+	buckets, err := slice(data, tdbHeaderSize+4, hashSize*4)
+	if err != nil {
+		return err
+	}
+	seen := make(map[uint32]bool)
+	for i := uint64(0); i < hashSize; i++ {
+		for offset := order.Uint32(buckets[i*4:]); offset != 0; {
+			if seen[offset] {
+				return fmt.Errorf("loop in hash chain at offset %d", offset)
+			}
+			seen[offset] = true
+			// next, rec_len, key_len, data_len, full_hash, magic
+			header, err := slice(data, uint64(offset), tdbRecordHeaderSize)
+			if err != nil {
+				return err
+			}
+			keyLen, dataLen := uint64(order.Uint32(header[8:])), uint64(order.Uint32(header[12:]))
+			if order.Uint32(header[20:]) == tdbMagic {
+				record, err := slice(data, uint64(offset)+tdbRecordHeaderSize, keyLen+dataLen)
+				if err != nil {
+					return err
+				}
+				if err := fn(record[:keyLen], record[keyLen:], order); err != nil {
+					return err
+				}
+			}
+			offset = order.Uint32(header)
+		}
+	}
+	return nil
+}
+
+// readBDBHash reads the hash pages of a Berkeley DB (version 2 and later) hash database. Keys and values are stored
+// in pairs, either on the page itself, or for large items on a chain of overflow pages.
+func readBDBHash(data []byte, order binary.ByteOrder, fn func(key, value []byte, order binary.ByteOrder) error) error {
+	// lsn, pgno, magic, version, pagesize, encrypt_alg, type
+	if len(data) < bdbPageHeaderSize {
+		return errHintsFormat
+	}
+	pageSize := uint64(order.Uint32(data[20:]))
+	if data[25] != bdbPageHashMeta || data[24] != 0 || pageSize < 512 {
+		return errHintsFormat
+	}
+	overflow := func(pgno uint32, length uint64) ([]byte, error) {
+		value := make([]byte, 0, length)
+		for pages := 0; pgno != 0 && uint64(len(value)) < length; pages++ {
+			if uint64(pages) > uint64(len(data))/pageSize {
+				return nil, fmt.Errorf("loop in overflow chain at page %d", pgno)
+			}
+			page, err := slice(data, uint64(pgno)*pageSize, pageSize)
+			if err != nil {
+				return nil, err
+			}
+			if page[25] != bdbPageOverflow {
+				return nil, fmt.Errorf("page %d is not an overflow page", pgno)
+			}
+			chunk, err := slice(page, bdbPageHeaderSize, uint64(order.Uint16(page[22:])))
+			if err != nil {
+				return nil, err
+			}
+			value = append(value, chunk...)
+			pgno = order.Uint32(page[16:])
+		}
+		if uint64(len(value)) != length {
+			return nil, fmt.Errorf("overflow item is %d bytes, expected %d", len(value), length)
+		}
+		return value, nil
+	}
+
+	for pgno := uint64(1); (pgno+1)*pageSize <= uint64(len(data)); pgno++ {
+		page := data[pgno*pageSize : (pgno+1)*pageSize]
+		if page[25] != bdbPageHash && page[25] != bdbPageHashUnsorted {
+			continue
+		}
+		// Each item is stored from the end of the page backwards, so its length is the gap to the previous one
+		entries := uint64(order.Uint16(page[20:]))
+		items := make([][]byte, 0, entries)
+		end := pageSize
+		for i := uint64(0); i < entries; i++ {
+			index, err := slice(page, bdbPageHeaderSize+i*2, 2)
+			if err != nil {
+				return err
+			}
+			start := uint64(order.Uint16(index))
+			if start >= end {
+				return fmt.Errorf("invalid item offset %d on page %d", start, pgno)
+			}
+			item := page[start:end]
+			end = start
+			switch item[0] {
+			case bdbItemKeyData:
+				items = append(items, item[1:])
+			case bdbItemOffPage:
+				if len(item) < 12 {
+					return fmt.Errorf("truncated overflow item on page %d", pgno)
+				}
+				value, err := overflow(order.Uint32(item[4:]), uint64(order.Uint32(item[8:])))
+				if err != nil {
+					return err
+				}
+				items = append(items, value)
+			default:
+				// Exim doesn't store duplicate keys
+				return fmt.Errorf("unsupported item type %d on page %d", item[0], pgno)
+			}
+		}
+		for i := 0; i+1 < len(items); i += 2 {
+			if err := fn(items[i], items[i+1], order); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// RetryDB caches the records of the retry hints database, which is only read again when it changes.
+type RetryDB struct {
+	mu      sync.Mutex
+	size    int64
+	mtime   time.Time
+	records []RetryRecord
+}
+
+// retryDBPath returns the path of the retry hints database. Depending on the DBM library, the file may have a .db
+// suffix.
+func (e *Exporter) retryDBPath() string {
+	dirname := *hintsPath
+	if dirname == "" {
+		dirname = filepath.Join(filepath.Dir(e.inputPath), "db")
+	}
+	filename := filepath.Join(dirname, "retry")
+	if _, err := os.Stat(filename); err != nil {
+		if _, err := os.Stat(filename + ".db"); err == nil {
+			return filename + ".db"
+		}
+	}
+	return filename
+}
+
+// RetryRecords returns the records in the retry hints database. The database isn't locked, so a read racing with an
+// update by exim may fail, in which case it will be read again on the next scrape.
+func (e *Exporter) RetryRecords() ([]RetryRecord, error) {
+	filename := e.retryDBPath()
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	e.retryDB.mu.Lock()
+	defer e.retryDB.mu.Unlock()
+	if info.Size() == e.retryDB.size && info.ModTime().Equal(e.retryDB.mtime) {
+		return e.retryDB.records, nil
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]RetryRecord, 0)
+	err = readHintsDB(data, func(key, value []byte, order binary.ByteOrder) error {
+		record, err := parseRetryRecord(key, value, order)
+		if err != nil {
+			return err
+		}
+		records = append(records, record)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	e.retryDB.size, e.retryDB.mtime, e.retryDB.records = info.Size(), info.ModTime(), records
+	return records, nil
+}
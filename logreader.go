@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	bzip2Magic = []byte("BZh")
+	zstdMagic  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// openLog opens a log file for reading. Rotated logs compressed by logrotate are decompressed transparently,
+// detecting gzip, bzip2 and zstd by their magic bytes, or by extension if the file is too short to tell.
+func openLog(filename string) (io.ReadCloser, error) {
+	fh, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	buffered := bufio.NewReader(fh)
+	magic, _ := buffered.Peek(4)
+	ext := filepath.Ext(filename)
+
+	var reader io.ReadCloser
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic) || (len(magic) < 4 && ext == ".gz"):
+		reader, err = gzip.NewReader(buffered)
+	case bytes.HasPrefix(magic, bzip2Magic) || (len(magic) < 4 && ext == ".bz2"):
+		reader = io.NopCloser(bzip2.NewReader(buffered))
+	case bytes.HasPrefix(magic, zstdMagic) || (len(magic) < 4 && ext == ".zst"):
+		var decoder *zstd.Decoder
+		decoder, err = zstd.NewReader(buffered)
+		if err == nil {
+			reader = decoder.IOReadCloser()
+		}
+	default:
+		// Uncompressed logs are returned as they are, so they can be seeked
+		if _, err := fh.Seek(0, io.SeekStart); err != nil {
+			_ = fh.Close()
+			return nil, err
+		}
+		return fh, nil
+	}
+	if err != nil {
+		_ = fh.Close()
+		return nil, err
+	}
+	return &compressedLog{reader, fh}, nil
+}
+
+// isCompressedLog reports whether the log is decompressed by openLog.
+func isCompressedLog(filename string) bool {
+	reader, err := openLog(filename)
+	if err != nil {
+		return false
+	}
+	defer func() { _ = reader.Close() }()
+	_, plain := reader.(*os.File)
+	return !plain
+}
+
+// compressedLog closes both the decompressor and the underlying file.
+type compressedLog struct {
+	io.ReadCloser
+	file *os.File
+}
+
+func (c *compressedLog) Close() error {
+	_ = c.ReadCloser.Close()
+	return c.file.Close()
+}
@@ -1,14 +1,13 @@
 package main
 
 import (
-	"bufio"
 	"io"
 	stdlog "log"
 	"log/syslog"
 	"net/http"
 	"os"
+	"os/signal"
 	"path"
-	"path/filepath"
 	"regexp"
 	"strings"
 	"syscall"
@@ -27,23 +26,46 @@ import (
 	"github.com/prometheus/exporter-toolkit/web"
 
 	"github.com/nxadm/tail"
-	"github.com/shirou/gopsutil/v3/process"
 )
 
 var (
-	logPath          = kingpin.Flag("exim.log-path", "Path to Exim panic log file.").Default("/var/log/exim4").Envar("EXIM_LOG_PATH").String()
-	mainlog          = kingpin.Flag("exim.mainlog", "Path to Exim main log file.").Default("mainlog").Envar("EXIM_MAINLOG").String()
-	rejectlog        = kingpin.Flag("exim.rejectlog", "Path to Exim reject log file.").Default("rejectlog").Envar("EXIM_REJECTLOG").String()
-	paniclog         = kingpin.Flag("exim.paniclog", "Path to Exim panic log file.").Default("paniclog").Envar("EXIM_PANICLOG").String()
-	eximExec         = kingpin.Flag("exim.executable", "Name of the Exim daemon executable.").Default("exim4").Envar("EXIM_EXECUTABLE").String()
-	inputPath        = kingpin.Flag("exim.input-path", "Path to Exim queue directory.").Default("/var/spool/exim4/input").Envar("EXIM_QUEUE_DIR").Envar("EXIM_INPUT_PATH").String()
-	useJournal       = kingpin.Flag("exim.use-journal", "Use the journal instead of log file tailing").Envar("EXIM_USE_JOURNAL").Bool()
-	syslogIdentifier = kingpin.Flag("exim.syslog-identifier", "Syslog identifier used by Exim").Default("exim").Envar("EXIM_SYSLOG_IDENTIFIER").String()
-	tailPoll         = kingpin.Flag("tail.poll", "Poll logs for changes instead of using inotify.").Envar("TAIL_POLL").Bool()
-	frozenTimeout    = kingpin.Flag("queue.read-timeout", "Duration before reading the headers of all queued messages is aborted").Default("5s").Envar("QUEUE_READ_TIMEOUT").Duration()
-	listenAddress    = kingpin.Flag("web.listen-address", "Address to listen on for web interface and telemetry.").Default(":9636").Envar("WEB_LISTEN_ADDRESS").String()
-	metricsPath      = kingpin.Flag("web.telemetry-path", "Path under which to expose metrics.").Default("/metrics").Envar("WEB_TELEMETRY_PATH").String()
-	webConfigFile    = kingpin.Flag("web.config.file", "[EXPERIMENTAL] Path to configuration file that can enable TLS or authentication.").Default("").Envar("WEB_CONFIG_FILE").String()
+	logPath             = kingpin.Flag("exim.log-path", "Path to Exim panic log file.").Default("/var/log/exim4").Envar("EXIM_LOG_PATH").String()
+	mainlog             = kingpin.Flag("exim.mainlog", "Path to Exim main log file.").Default("mainlog").Envar("EXIM_MAINLOG").String()
+	rejectlog           = kingpin.Flag("exim.rejectlog", "Path to Exim reject log file.").Default("rejectlog").Envar("EXIM_REJECTLOG").String()
+	paniclog            = kingpin.Flag("exim.paniclog", "Path to Exim panic log file.").Default("paniclog").Envar("EXIM_PANICLOG").String()
+	eximExec            = kingpin.Flag("exim.executable", "Name of the Exim daemon executable.").Default("exim4").Envar("EXIM_EXECUTABLE").String()
+	inputPath           = kingpin.Flag("exim.input-path", "Path to Exim queue directory.").Default("/var/spool/exim4/input").Envar("EXIM_QUEUE_DIR").Envar("EXIM_INPUT_PATH").String()
+	hintsPath           = kingpin.Flag("exim.hints-path", "Path to Exim hints database directory. Defaults to the db directory next to the input path.").Default("").Envar("EXIM_HINTS_PATH").String()
+	procfsPath          = kingpin.Flag("path.procfs", "Procfs mountpoint used to find exim processes, such as the host's /proc mounted into a container.").Default("/proc").Envar("PATH_PROCFS").String()
+	useJournal          = kingpin.Flag("exim.use-journal", "Use the journal instead of log file tailing").Envar("EXIM_USE_JOURNAL").Bool()
+	syslogIdentifier    = kingpin.Flag("exim.syslog-identifier", "Syslog identifier used by Exim").Default("exim").Envar("EXIM_SYSLOG_IDENTIFIER").String()
+	tailPoll            = kingpin.Flag("tail.poll", "Poll logs for changes instead of using inotify.").Envar("TAIL_POLL").Bool()
+	checkpointFile      = kingpin.Flag("tail.checkpoint-file", "Path to a file used to save log read positions, so tailing resumes where it left off after a restart.").Default("").Envar("TAIL_CHECKPOINT_FILE").String()
+	checkpointEvery     = kingpin.Flag("tail.checkpoint-interval", "How often log read positions are saved to the checkpoint file.").Default("10s").Envar("TAIL_CHECKPOINT_INTERVAL").Duration()
+	checkpointMaxReplay = kingpin.Flag("tail.checkpoint-max-replay", "Maximum amount of each log file to replay when resuming from a checkpoint, or 0 for no limit.").Default("64MB").Envar("TAIL_CHECKPOINT_MAX_REPLAY").Bytes()
+	checkpointMaxAge    = kingpin.Flag("tail.checkpoint-max-age", "Maximum age of journal entries to replay when resuming from a checkpoint, or 0 for no limit.").Default("24h").Envar("TAIL_CHECKPOINT_MAX_AGE").Duration()
+	stateFile           = kingpin.Flag("state.file", "Path to a file used to save the log derived counters, so their totals survive restarts.").Default("").Envar("STATE_FILE").String()
+	stateInterval       = kingpin.Flag("state.interval", "How often counters are saved to the state file.").Default("1m").Envar("STATE_INTERVAL").Duration()
+	queueWatch          = kingpin.Flag("queue.watch", "Watch the spool for changes with inotify, instead of reading it on each scrape.").Envar("QUEUE_WATCH").Bool()
+	queueWatchResync    = kingpin.Flag("queue.watch-resync", "How often the watched spool is read in full, to correct for any missed changes.").Default("5m").Envar("QUEUE_WATCH_RESYNC").Duration()
+	queueScanInterval   = kingpin.Flag("queue.scan-interval", "Scan the queue in the background at this interval and serve the last result to scrapes, or 0 to scan on each scrape.").Default("0s").Envar("QUEUE_SCAN_INTERVAL").Duration()
+	queueConcurrency    = kingpin.Flag("queue.concurrency", "Number of spool directories and message headers read concurrently while scanning the queue.").Default("4").Envar("QUEUE_CONCURRENCY").Int()
+	queueTopDomains     = kingpin.Flag("queue.top-domains", "Number of sender and recipient domains with the most queued messages to report, or 0 to disable.").Default("10").Envar("QUEUE_TOP_DOMAINS").Int()
+	queueCheckLocks     = kingpin.Flag("queue.check-locks", "Check which queued messages are locked by a delivery process, which requires opening every data file on each scan.").Envar("QUEUE_CHECK_LOCKS").Bool()
+	queueReadMsglog     = kingpin.Flag("queue.read-msglog", "Read the message log of each queued message, to report delivery attempts and deferral reasons.").Envar("QUEUE_READ_MSGLOG").Bool()
+	queueCommand        = kingpin.Flag("queue.command", "Command printing exim -bp or exim -bpc output, such as \"sudo exim -bp\", to run instead of reading the spool.").Default("").Envar("QUEUE_COMMAND").String()
+	frozenTimeout       = kingpin.Flag("queue.read-timeout", "Maximum time spent reading the headers of new queued messages per scrape, or 0 for no limit").Default("5s").Envar("QUEUE_READ_TIMEOUT").Duration()
+	listenAddress       = kingpin.Flag("web.listen-address", "Address to listen on for web interface and telemetry.").Default(":9636").Envar("WEB_LISTEN_ADDRESS").String()
+	metricsPath         = kingpin.Flag("web.telemetry-path", "Path under which to expose metrics.").Default("/metrics").Envar("WEB_TELEMETRY_PATH").String()
+	webQueueAPI         = kingpin.Flag("web.queue-api", "Serve a JSON listing of queued messages, including their senders and recipients, at /api/v1/queue.").Envar("WEB_QUEUE_API").Bool()
+	webConfigFile       = kingpin.Flag("web.config.file", "[EXPERIMENTAL] Path to configuration file that can enable TLS or authentication.").Default("").Envar("WEB_CONFIG_FILE").String()
+
+	serveCommand       = kingpin.Command("serve", "Run the exporter (default).").Default()
+	backfillCommand    = kingpin.Command("backfill", "Convert existing logs to OpenMetrics for promtool tsdb create-blocks-from openmetrics.")
+	backfillMainlogs   = backfillCommand.Flag("mainlog", "Main log file to read, oldest first. Can be repeated. Defaults to the main log and its rotated copies.").Strings()
+	backfillRejectlogs = backfillCommand.Flag("rejectlog", "Reject log file to read, oldest first. Can be repeated. Defaults to the reject log and its rotated copies.").Strings()
+	backfillOutput     = backfillCommand.Flag("output", "File to write OpenMetrics to, or - for stdout.").Short('o').Default("-").String()
+	backfillResolution = backfillCommand.Flag("resolution", "Interval between samples.").Default("1m").Duration()
 )
 
 const BASE62 = "0123456789aAbBcCdDeEfFgGhHiIjJkKlLmMnNoOpPqQrRsStTuUvVwWxXyYzZ"
@@ -57,12 +79,112 @@ var (
 	eximQueue = prometheus.NewDesc(
 		prometheus.BuildFQName("exim", "", "queue"),
 		"Number of messages currently in queue",
-		nil, nil,
+		[]string{"queue"}, nil,
 	)
 	eximQueueFrozen = prometheus.NewDesc(
 		prometheus.BuildFQName("exim", "", "queue_frozen"),
 		"Number of messages currently frozen in queue",
-		nil, nil,
+		[]string{"queue"}, nil,
+	)
+	eximQueueBytes = prometheus.NewDesc(
+		prometheus.BuildFQName("exim", "", "queue_bytes"),
+		"Size of the header and data files of messages currently in queue",
+		[]string{"queue"}, nil,
+	)
+	eximQueueRecipients = prometheus.NewDesc(
+		prometheus.BuildFQName("exim", "", "queue_recipients"),
+		"Number of recipients of messages currently in queue",
+		[]string{"queue"}, nil,
+	)
+	eximQueueRecipientsPending = prometheus.NewDesc(
+		prometheus.BuildFQName("exim", "", "queue_recipients_pending"),
+		"Number of recipients not yet delivered to of messages currently in queue",
+		[]string{"queue"}, nil,
+	)
+	eximQueueSenderDomain = prometheus.NewDesc(
+		prometheus.BuildFQName("exim", "", "queue_sender_domain"),
+		"Number of messages currently in queue from the sender domains with the most messages",
+		[]string{"queue", "domain"}, nil,
+	)
+	eximQueueRecipientDomain = prometheus.NewDesc(
+		prometheus.BuildFQName("exim", "", "queue_recipient_domain"),
+		"Number of messages currently in queue with pending recipients at the recipient domains with the most messages",
+		[]string{"queue", "domain"}, nil,
+	)
+	eximQueueOrphaned = prometheus.NewDesc(
+		prometheus.BuildFQName("exim", "", "queue_orphaned_files"),
+		"Number of message header or data files currently in queue without the other file",
+		[]string{"queue", "type"}, nil,
+	)
+	eximQueueDirectoryEntries = prometheus.NewDesc(
+		prometheus.BuildFQName("exim", "", "queue_directory_entries"),
+		"Number of entries in each queue directory, including hash directories and temporary files",
+		[]string{"queue", "directory"}, nil,
+	)
+	eximQueueInvalid = prometheus.NewDesc(
+		prometheus.BuildFQName("exim", "", "queue_invalid_headers"),
+		"Number of message header files currently in queue which couldn't be parsed",
+		[]string{"queue"}, nil,
+	)
+	eximQueueLocked = prometheus.NewDesc(
+		prometheus.BuildFQName("exim", "", "queue_locked"),
+		"Number of messages currently in queue locked by a delivery process",
+		[]string{"queue"}, nil,
+	)
+	eximQueueDeferred = prometheus.NewDesc(
+		prometheus.BuildFQName("exim", "", "queue_deferred"),
+		"Number of messages currently in queue broken down by the reason for their last deferral",
+		[]string{"queue", "reason"}, nil,
+	)
+	eximQueueAttempts = prometheus.NewDesc(
+		prometheus.BuildFQName("exim", "", "queue_delivery_attempts"),
+		"Number of delivery attempts of messages currently in queue",
+		[]string{"queue"}, nil,
+	)
+	eximQueueFlags = prometheus.NewDesc(
+		prometheus.BuildFQName("exim", "", "queue_flags"),
+		"Number of messages currently in queue broken down by spool flag (local_error, tls, etc)",
+		[]string{"queue", "flag"}, nil,
+	)
+	eximQueueAge = prometheus.NewDesc(
+		prometheus.BuildFQName("exim", "", "queue_age_seconds"),
+		"Time since queued messages were received",
+		[]string{"queue"}, nil,
+	)
+	eximQueueOldest = prometheus.NewDesc(
+		prometheus.BuildFQName("exim", "", "queue_oldest_seconds"),
+		"Time since the oldest message in queue was received",
+		[]string{"queue"}, nil,
+	)
+	eximFilesystemAvail = prometheus.NewDesc(
+		prometheus.BuildFQName("exim", "", "filesystem_avail_bytes"),
+		"Space available to unprivileged users on the filesystem holding the spool or log directory",
+		[]string{"directory"}, nil,
+	)
+	eximFilesystemSize = prometheus.NewDesc(
+		prometheus.BuildFQName("exim", "", "filesystem_size_bytes"),
+		"Size of the filesystem holding the spool or log directory",
+		[]string{"directory"}, nil,
+	)
+	eximFilesystemFilesFree = prometheus.NewDesc(
+		prometheus.BuildFQName("exim", "", "filesystem_files_free"),
+		"Number of free inodes on the filesystem holding the spool or log directory",
+		[]string{"directory"}, nil,
+	)
+	eximFilesystemFiles = prometheus.NewDesc(
+		prometheus.BuildFQName("exim", "", "filesystem_files"),
+		"Number of inodes on the filesystem holding the spool or log directory",
+		[]string{"directory"}, nil,
+	)
+	eximRetryRecords = prometheus.NewDesc(
+		prometheus.BuildFQName("exim", "", "retry_records"),
+		"Number of records in the retry hints database broken down by type (routing, transport)",
+		[]string{"type"}, nil,
+	)
+	eximRetryOldest = prometheus.NewDesc(
+		prometheus.BuildFQName("exim", "", "retry_oldest_seconds"),
+		"Time since the first failure of the oldest record in the retry hints database",
+		[]string{"type"}, nil,
 	)
 	eximQueueStateTimeoutErrors = prometheus.NewCounter(
 		prometheus.CounterOpts{
@@ -70,31 +192,60 @@ var (
 			Help: "Total number of errors encountered while reading the logs",
 		},
 	)
+	eximQueueScanDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    prometheus.BuildFQName("exim", "", "queue_scan_duration_seconds"),
+			Help:    "Time taken to scan the queue",
+			Buckets: []float64{.001, .005, .01, .05, .1, .5, 1, 5, 10, 30, 60},
+		},
+	)
+	eximQueueScanErrors = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: prometheus.BuildFQName("exim", "", "queue_scan_errors_total"),
+			Help: "Total number of failed scans of the queue",
+		},
+	)
+	eximQueueRunners = prometheus.NewDesc(
+		prometheus.BuildFQName("exim", "", "queue_runners"),
+		"Number of running queue runner processes broken down by queue",
+		[]string{"queue"}, nil,
+	)
 	eximProcesses = prometheus.NewDesc(
 		prometheus.BuildFQName("exim", "", "processes"),
 		"Number of running exim process broken down by state (delivering, handling, etc)",
 		[]string{"state"}, nil,
 	)
-	eximMessages = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: prometheus.BuildFQName("exim", "", "messages_total"),
-			Help: "Total number of logged messages broken down by flag (delivered, deferred, etc)",
-		},
-		[]string{"flag"},
+	eximProcessCPU = prometheus.NewDesc(
+		prometheus.BuildFQName("exim", "", "processes_cpu_seconds"),
+		"CPU time used by the running exim processes broken down by state",
+		[]string{"state"}, nil,
 	)
-	eximMessageErrors = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: prometheus.BuildFQName("exim", "", "message_errors_total"),
-			Help: "Number of logged messages broken down by error code (451, 550, etc)",
-		},
-		[]string{"status", "enhanced"},
+	eximProcessMemory = prometheus.NewDesc(
+		prometheus.BuildFQName("exim", "", "processes_resident_memory_bytes"),
+		"Resident memory of the running exim processes broken down by state",
+		[]string{"state"}, nil,
 	)
-	eximReject = prometheus.NewCounter(
-		prometheus.CounterOpts{
-			Name: prometheus.BuildFQName("exim", "", "reject_total"),
-			Help: "Total number of logged reject messages",
-		},
+	eximProcessFDs = prometheus.NewDesc(
+		prometheus.BuildFQName("exim", "", "processes_open_fds"),
+		"Number of file descriptors opened by the running exim processes broken down by state",
+		[]string{"state"}, nil,
+	)
+	eximProcessAge = prometheus.NewDesc(
+		prometheus.BuildFQName("exim", "", "processes_age_seconds"),
+		"Time since the running exim processes were started broken down by state",
+		[]string{"state"}, nil,
+	)
+	eximProcessOldest = prometheus.NewDesc(
+		prometheus.BuildFQName("exim", "", "processes_oldest_seconds"),
+		"Time since the oldest running exim process in each state was started",
+		[]string{"state"}, nil,
 	)
+	// The log derived counters served by the exporter. Backfill counts into a set of its own.
+	logCounts         = newLogCounters()
+	eximMessages      = logCounts.messages
+	eximMessageErrors = logCounts.messageErrors
+	eximReject        = logCounts.reject
+
 	eximPanic = prometheus.NewCounter(
 		prometheus.CounterOpts{
 			Name: prometheus.BuildFQName("exim", "", "panic_total"),
@@ -109,41 +260,37 @@ var (
 	)
 )
 
-var processFlags = map[string]string{
-	"-Mc":  "delivering",
-	"-bd":  "handling",
-	"-bdf": "handling",
-	"-q":   "running",
-	"-qG":  "running",
-}
+var processAgeBuckets = []float64{1, 10, 60, 300, 900, 1800, 3600, 7200, 21600, 86400}
 
 type Process struct {
 	cmdline []string
 	leader  bool
+	// Start time and resource usage, which are only read for exim processes
+	started    time.Time
+	cpuSeconds float64
+	rss        float64
+	fds        float64
+}
+
+// ProcessStats counts the exim processes in a state, and adds up the resources they're using.
+type ProcessStats struct {
+	count      float64
+	cpuSeconds float64
+	rss        float64
+	fds        float64
+	ages       QueueHistogram
 }
 
 // map globals we can override in tests
 var (
+	timeNow = time.Now
+
+	datestampCheckInterval = 10 * time.Second
+
+	statfs = syscall.Statfs
+
 	getProcesses = func() ([]*Process, error) {
-		processes, err := process.Processes()
-		if err != nil {
-			return nil, err
-		}
-		result := make([]*Process, 0)
-		for _, p := range processes {
-			cmdline, err := p.CmdlineSlice()
-			if err != nil {
-				continue
-			}
-			pid := int(p.Pid)
-			pgid, err := syscall.Getpgid(pid)
-			if err != nil {
-				continue
-			}
-			leader := pid == pgid
-			result = append(result, &Process{cmdline, leader})
-		}
-		return result, nil
+		return readProcesses(*procfsPath, *eximExec)
 	}
 )
 
@@ -152,32 +299,31 @@ var (
 var errorCodeRegexp = regexp.MustCompile(": ([2-5][0-9]{2})[ -]([2-5]\\.[0-9]{1,3}\\.[0-9]{1,3})?")
 
 type Exporter struct {
-	mainlog   string
-	rejectlog string
-	paniclog  string
-	eximBin   string
-	inputPath string
-	logLevel  string
-	logger    log.Logger
+	mainlog    string
+	rejectlog  string
+	paniclog   string
+	eximBin    string
+	inputPath  string
+	logLevel   string
+	logger     log.Logger
+	checkpoint *Checkpoint
+	spool      *SpoolCache
+	scanner    *QueueScanner
+	retryDB    *RetryDB
 }
 
-type QueueSize struct {
-	total    float64
-	frozen   float64
-	timedOut bool
-}
-
-var queueSizeLastTimeout float64
-
 func NewExporter(mainlog, rejectlog, paniclog, eximExec, inputPath, logLevel string, logger log.Logger) *Exporter {
 	return &Exporter{
-		mainlog,
-		rejectlog,
-		paniclog,
-		eximExec,
-		inputPath,
-		logLevel,
-		logger,
+		mainlog:   mainlog,
+		rejectlog: rejectlog,
+		paniclog:  paniclog,
+		eximBin:   eximExec,
+		inputPath: inputPath,
+		logLevel:  logLevel,
+		logger:    logger,
+		spool:     NewSpoolCache(),
+		scanner:   NewQueueScanner(),
+		retryDB:   &RetryDB{},
 	}
 }
 
@@ -185,143 +331,179 @@ func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
 	ch <- eximUp
 	ch <- eximQueue
 	ch <- eximQueueFrozen
+	ch <- eximQueueFlags
+	ch <- eximQueueDeferred
+	ch <- eximQueueAttempts
+	ch <- eximQueueOrphaned
+	ch <- eximQueueInvalid
+	ch <- eximQueueDirectoryEntries
+	ch <- eximQueueLocked
+	ch <- eximQueueSenderDomain
+	ch <- eximQueueRecipientDomain
+	ch <- eximQueueBytes
+	ch <- eximQueueRecipients
+	ch <- eximQueueRecipientsPending
+	ch <- eximQueueAge
+	ch <- eximQueueOldest
+	ch <- eximQueueRunners
 	ch <- eximProcesses
+	ch <- eximProcessCPU
+	ch <- eximProcessMemory
+	ch <- eximProcessFDs
+	ch <- eximProcessAge
+	ch <- eximProcessOldest
+	ch <- eximFilesystemAvail
+	ch <- eximFilesystemSize
+	ch <- eximFilesystemFilesFree
+	ch <- eximFilesystemFiles
+	ch <- eximRetryRecords
+	ch <- eximRetryOldest
 }
 
 func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
-	states := e.ProcessStates()
+	states, runners := e.ProcessStates()
 	up := float64(0)
 	if _, ok := states["daemon"]; ok {
 		up = 1
 	}
 	ch <- prometheus.MustNewConstMetric(eximUp, prometheus.GaugeValue, up)
-	for label, value := range states {
-		ch <- prometheus.MustNewConstMetric(eximProcesses, prometheus.GaugeValue, value, label)
+	for label, stats := range states {
+		ch <- prometheus.MustNewConstMetric(eximProcesses, prometheus.GaugeValue, stats.count, label)
+		ch <- prometheus.MustNewConstMetric(eximProcessCPU, prometheus.GaugeValue, stats.cpuSeconds, label)
+		ch <- prometheus.MustNewConstMetric(eximProcessMemory, prometheus.GaugeValue, stats.rss, label)
+		ch <- prometheus.MustNewConstMetric(eximProcessFDs, prometheus.GaugeValue, stats.fds, label)
+		ch <- prometheus.MustNewConstHistogram(eximProcessAge, stats.ages.count, stats.ages.sum, stats.ages.Buckets(), label)
+		ch <- prometheus.MustNewConstMetric(eximProcessOldest, prometheus.GaugeValue, stats.ages.max, label)
 	}
-	queue := e.QueueSize()
-	ch <- prometheus.MustNewConstMetric(eximQueue, prometheus.GaugeValue, queue.total)
-	ch <- prometheus.MustNewConstMetric(eximQueueFrozen, prometheus.GaugeValue, queue.frozen)
-}
-
-func (e *Exporter) ProcessStates() map[string]float64 {
-	_ = level.Debug(e.logger).Log("msg", "Reading process states")
-	states := make(map[string]float64)
-	processes, err := getProcesses()
-	if err != nil {
-		_ = level.Error(e.logger).Log("msg", err)
-		return states
+	for queue, value := range runners {
+		ch <- prometheus.MustNewConstMetric(eximQueueRunners, prometheus.GaugeValue, value, queue)
 	}
-	for _, p := range processes {
-		if len(p.cmdline) < 1 || path.Base(p.cmdline[0]) != e.eximBin {
+	for directory, dirname := range e.filesystemDirs() {
+		var stat syscall.Statfs_t
+		if err := statfs(dirname, &stat); err != nil {
+			_ = level.Warn(e.logger).Log("msg", "Unable to read filesystem usage", "path", dirname, "err", err)
 			continue
 		}
-		if len(p.cmdline) < 2 {
-			states["other"] += 1
-		} else if state, ok := processFlags[p.cmdline[1]]; ok {
-			if state == "handling" && p.leader {
-				states["daemon"] += 1
-			} else {
-				states[state] += 1
+		ch <- prometheus.MustNewConstMetric(eximFilesystemAvail, prometheus.GaugeValue, float64(stat.Bavail)*float64(stat.Bsize), directory)
+		ch <- prometheus.MustNewConstMetric(eximFilesystemSize, prometheus.GaugeValue, float64(stat.Blocks)*float64(stat.Bsize), directory)
+		ch <- prometheus.MustNewConstMetric(eximFilesystemFilesFree, prometheus.GaugeValue, float64(stat.Ffree), directory)
+		ch <- prometheus.MustNewConstMetric(eximFilesystemFiles, prometheus.GaugeValue, float64(stat.Files), directory)
+	}
+	e.collectRetryRecords(ch)
+	var queue QueueSize
+	if *queueScanInterval > 0 {
+		queue = e.CachedQueue()
+	} else {
+		queue = e.ScanQueue()
+	}
+	for name, stats := range queue.queues {
+		ch <- prometheus.MustNewConstMetric(eximQueue, prometheus.GaugeValue, stats.total, name)
+		ch <- prometheus.MustNewConstMetric(eximQueueFrozen, prometheus.GaugeValue, stats.frozen, name)
+		ch <- prometheus.MustNewConstMetric(eximQueueOrphaned, prometheus.GaugeValue, stats.orphanedHeaders, name, "header")
+		ch <- prometheus.MustNewConstMetric(eximQueueOrphaned, prometheus.GaugeValue, stats.orphanedData, name, "data")
+		ch <- prometheus.MustNewConstMetric(eximQueueInvalid, prometheus.GaugeValue, stats.invalid, name)
+		for directory, value := range stats.directories {
+			ch <- prometheus.MustNewConstMetric(eximQueueDirectoryEntries, prometheus.GaugeValue, value, name, directory)
+		}
+		if *queueCheckLocks {
+			ch <- prometheus.MustNewConstMetric(eximQueueLocked, prometheus.GaugeValue, stats.locked, name)
+		}
+		if *queueReadMsglog {
+			for reason, value := range stats.deferred {
+				ch <- prometheus.MustNewConstMetric(eximQueueDeferred, prometheus.GaugeValue, value, name, reason)
 			}
-		} else {
-			isDaemon := false
-			if p.leader {
-				for _, arg := range p.cmdline {
-					if arg == "-bd" || arg == "-bdf" {
-						isDaemon = true
-					}
-				}
+			ch <- prometheus.MustNewConstHistogram(eximQueueAttempts, stats.attempts.count, stats.attempts.sum, stats.attempts.Buckets(), name)
+		}
+		ch <- prometheus.MustNewConstMetric(eximQueueBytes, prometheus.GaugeValue, stats.bytes, name)
+		ch <- prometheus.MustNewConstMetric(eximQueueRecipients, prometheus.GaugeValue, stats.recipients, name)
+		ch <- prometheus.MustNewConstMetric(eximQueueRecipientsPending, prometheus.GaugeValue, stats.pending, name)
+		if *queueTopDomains > 0 {
+			for _, domain := range topDomains(stats.senderDomains, *queueTopDomains) {
+				ch <- prometheus.MustNewConstMetric(eximQueueSenderDomain, prometheus.GaugeValue, domain.Count, name, domain.Domain)
 			}
-			if isDaemon {
-				states["daemon"] += 1
-			} else {
-				states["other"] += 1
+			for _, domain := range topDomains(stats.recipientDomains, *queueTopDomains) {
+				ch <- prometheus.MustNewConstMetric(eximQueueRecipientDomain, prometheus.GaugeValue, domain.Count, name, domain.Domain)
 			}
 		}
+		for i, flag := range queueFlags {
+			ch <- prometheus.MustNewConstMetric(eximQueueFlags, prometheus.GaugeValue, stats.flags[i], name, flag.label)
+		}
+		ch <- prometheus.MustNewConstHistogram(eximQueueAge, stats.ages.count, stats.ages.sum, stats.ages.Buckets(), name)
+		ch <- prometheus.MustNewConstMetric(eximQueueOldest, prometheus.GaugeValue, stats.ages.max, name)
 	}
-	return states
 }
 
-func (e *Exporter) CountMessages(dirname string, queueSize *QueueSize, deadline time.Time) {
-	dir, err := os.Open(dirname)
-	if err != nil {
+func (e *Exporter) collectRetryRecords(ch chan<- prometheus.Metric) {
+	records, err := e.RetryRecords()
+	if os.IsNotExist(err) {
+		// Not created until exim first defers a delivery
+		_ = level.Debug(e.logger).Log("msg", "No retry hints database", "err", err)
 		return
 	}
-	messages, err := dir.Readdirnames(-1)
-	_ = dir.Close()
 	if err != nil {
+		_ = level.Warn(e.logger).Log("msg", "Unable to read retry hints database", "err", err)
 		return
 	}
-	var lineNumber int
-	for _, fileName := range messages {
-		// message ID in exim >= 4.97 are 25 chars
-		// message ID in exim < 4.97 are only 18 chars
-		// Each message has a header and data file, so only count one of them
-		if !(len(fileName) == 25 || len(fileName) == 18) || !strings.HasSuffix(fileName, "-H") {
+	counts := map[string]float64{"routing": 0, "transport": 0}
+	oldest := make(map[string]float64)
+	now := timeNow()
+	for _, record := range records {
+		recordType := record.Type()
+		if recordType == "" {
 			continue
 		}
-		queueSize.total += 1
+		counts[recordType] += 1
+		oldest[recordType] = max(oldest[recordType], now.Sub(record.FirstFailed).Seconds())
+	}
+	for recordType, count := range counts {
+		ch <- prometheus.MustNewConstMetric(eximRetryRecords, prometheus.GaugeValue, count, recordType)
+		ch <- prometheus.MustNewConstMetric(eximRetryOldest, prometheus.GaugeValue, oldest[recordType], recordType)
+	}
+}
 
-		if !deadline.IsZero() {
-			if queueSizeLastTimeout > 0 || queueSize.timedOut {
-				continue
-			} else if time.Now().After(deadline) {
-				queueSize.timedOut = true
-				queueSize.frozen = 0
-				eximQueueStateTimeoutErrors.Inc()
-				continue
-			}
-		}
+// filesystemDirs returns the directories whose filesystems are monitored, keyed by label. Logs read from the journal
+// aren't written by exim, so the log directory is only monitored when tailing log files.
+func (e *Exporter) filesystemDirs() map[string]string {
+	dirs := map[string]string{"spool": e.inputPath}
+	if !*useJournal {
+		dirs["log"] = path.Dir(resolveLogPath(e.mainlog, timeNow()))
+	}
+	return dirs
+}
 
-		headerFile, err := os.Open(path.Join(dirname, fileName))
-		if err != nil {
+// ProcessStates returns the exim processes in each state, and the number of queue runners for each queue.
+func (e *Exporter) ProcessStates() (map[string]*ProcessStats, map[string]float64) {
+	_ = level.Debug(e.logger).Log("msg", "Reading process states")
+	states := make(map[string]*ProcessStats)
+	runners := make(map[string]float64)
+	processes, err := getProcesses()
+	if err != nil {
+		_ = level.Error(e.logger).Log("msg", err)
+		return states, runners
+	}
+	now := timeNow()
+	for _, p := range processes {
+		if len(p.cmdline) < 1 || path.Base(p.cmdline[0]) != e.eximBin {
 			continue
 		}
-		// https://www.exim.org/exim-html-current/doc/html/spec_html/ch-format_of_spool_files.html
-		fileScanner := bufio.NewScanner(headerFile)
-		fileScanner.Split(bufio.ScanLines)
-		lineNumber = 0
-		for fileScanner.Scan() {
-			lineNumber++
-			// First four lines of the file contain fixed metadata
-			if lineNumber <= 4 {
-				continue
-			}
-			// Then follow a number of lines starting with a hyphen.
-			// These contain variables, which can appear in any order.
-			// If the line doesn't start with a hyphen, then we've reached the
-			// end of the variable section.
-			if !strings.HasPrefix(fileScanner.Text(), "-") {
-				break
-			}
-			// If we found the frozen flag, stop scanning, since that's all we care about for now.
-			if strings.HasPrefix(fileScanner.Text(), "-frozen ") {
-				queueSize.frozen++
-				break
-			}
+		state, queue := parseEximArgs(p.cmdline[1:], p.leader)
+		if state == "running" {
+			runners[queue] += 1
+		}
+		stats, ok := states[state]
+		if !ok {
+			stats = &ProcessStats{ages: newQueueHistogram(processAgeBuckets)}
+			states[state] = stats
+		}
+		stats.count += 1
+		stats.cpuSeconds += p.cpuSeconds
+		stats.rss += p.rss
+		stats.fds += p.fds
+		if !p.started.IsZero() {
+			stats.ages.Observe(now.Sub(p.started).Seconds())
 		}
 	}
-}
-
-func (e *Exporter) QueueSize() QueueSize {
-	_ = level.Debug(e.logger).Log("msg", "Reading queue size")
-	timeout := *frozenTimeout
-	var deadline time.Time
-	if timeout > 0 {
-		deadline = time.Now().Add(*frozenTimeout)
-	}
-	queueSize := QueueSize{}
-	e.CountMessages(e.inputPath, &queueSize, deadline)
-	for h := 0; h < len(BASE62); h++ {
-		hashPath := filepath.Join(e.inputPath, string(BASE62[h]))
-		e.CountMessages(hashPath, &queueSize, deadline)
-	}
-	if queueSize.timedOut {
-		queueSizeLastTimeout = queueSize.total
-	} else if queueSizeLastTimeout > 0 && queueSize.total < queueSizeLastTimeout*.9 {
-		queueSizeLastTimeout = 0
-	}
-	return queueSize
+	return states, runners
 }
 
 func (e *Exporter) Start() {
@@ -337,6 +519,12 @@ func (e *Exporter) Start() {
 }
 
 func (e *Exporter) FileTail(filename string) chan *tail.Line {
+	lines := make(chan *tail.Line)
+	go e.followLog(filename, lines)
+	return lines
+}
+
+func (e *Exporter) openTail(filename string, location *tail.SeekInfo) *tail.Tail {
 	_ = level.Info(e.logger).Log("msg", "Opening log", "filename", filename)
 	var logger *stdlog.Logger
 	if e.logLevel == "debug" || e.logLevel == "info" {
@@ -346,7 +534,7 @@ func (e *Exporter) FileTail(filename string) chan *tail.Line {
 		logger = tail.DiscardingLogger
 	}
 	t, err := tail.TailFile(filename, tail.Config{
-		Location:      &tail.SeekInfo{Whence: io.SeekEnd},
+		Location:      location,
 		ReOpen:        true,
 		Follow:        true,
 		CompleteLines: true,
@@ -357,7 +545,77 @@ func (e *Exporter) FileTail(filename string) chan *tail.Line {
 		_ = level.Error(e.logger).Log("msg", "Unable to open log", "err", err)
 		os.Exit(1)
 	}
-	return t.Lines
+	return t
+}
+
+// Exim expands %D and %M in log_file_path to the current date (yyyymmdd) and month (yyyymm),
+// switching to a new file when the date changes.
+func isDatestamped(filename string) bool {
+	return strings.Contains(filename, "%D") || strings.Contains(filename, "%M")
+}
+
+func resolveLogPath(filename string, now time.Time) string {
+	return strings.NewReplacer("%D", now.Format("20060102"), "%M", now.Format("200601")).Replace(filename)
+}
+
+// followLog sends the lines appended to the log to the channel, resuming from the last checkpoint if there is one.
+// For datestamped logs, the file matching the current date is followed. Once Exim creates the file for the next
+// period, the old file is read to the end before switching over, and the new file is read from the beginning.
+func (e *Exporter) followLog(template string, lines chan *tail.Line) {
+	current := resolveLogPath(template, timeNow())
+	location := e.resumeLog(template, current, lines)
+	t := e.openTail(current, location)
+	// The offset after the last line sent from the current file
+	var offset int64
+	if location != nil && location.Whence == io.SeekEnd {
+		offset = fileSize(current)
+	} else if location != nil {
+		offset = location.Offset
+	}
+	e.checkpoint.Start(template, current, offset)
+
+	var check <-chan time.Time
+	if isDatestamped(template) {
+		ticker := time.NewTicker(datestampCheckInterval)
+		defer ticker.Stop()
+		check = ticker.C
+	}
+	for {
+		select {
+		case line, ok := <-t.Lines:
+			if !ok {
+				close(lines)
+				return
+			}
+			lines <- line
+			offset = line.SeekInfo.Offset
+			e.checkpoint.Update(template, current, offset)
+		case <-check:
+			next := resolveLogPath(template, timeNow())
+			if next == current {
+				continue
+			}
+			if _, err := os.Stat(next); err != nil {
+				continue
+			}
+			_ = level.Info(e.logger).Log("msg", "Switching to new datestamped log", "from", current, "to", next)
+			old := t
+			go func() { _ = old.StopAtEOF() }()
+			for line := range old.Lines {
+				lines <- line
+				offset = line.SeekInfo.Offset
+				e.checkpoint.Update(template, current, offset)
+			}
+			old.Cleanup()
+			// The tail stops as soon as it's told to, without reading lines written since it last woke up, so the rest
+			// of the old file is read here.
+			e.readRemainder(template, current, offset, lines)
+			current = next
+			offset = 0
+			t = e.openTail(current, nil)
+			e.checkpoint.Start(template, current, offset)
+		}
+	}
 }
 
 // JournalTail conditionally defined based on the "systemd" build tag.
@@ -370,61 +628,102 @@ func (e *Exporter) TailMainLog(lines chan *tail.Line) {
 			continue
 		}
 		_ = level.Debug(e.logger).Log("file", "mainlong", "msg", line.Text)
-		parts := strings.SplitN(line.Text, " ", 7)
-		size := len(parts)
-		if size < 3 {
-			continue
-		}
+		e.ProcessMainLogLine(line.Text)
+	}
+}
 
-		index := 2
-		// Handle logs when timestamps are enabled
-		if parts[index][0] == '+' || parts[index][0] == '-' {
-			index++
-		}
+// logCounters are the counters incremented for lines of the main log and reject log.
+type logCounters struct {
+	messages      *prometheus.CounterVec
+	messageErrors *prometheus.CounterVec
+	reject        prometheus.Counter
+}
 
-		// Handle logs when PID logging is enabled
-		if parts[index][0] == '[' {
-			index++
-		}
+func newLogCounters() *logCounters {
+	return &logCounters{
+		messages: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: prometheus.BuildFQName("exim", "", "messages_total"),
+				Help: "Total number of logged messages broken down by flag (delivered, deferred, etc)",
+			},
+			[]string{"flag"},
+		),
+		messageErrors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: prometheus.BuildFQName("exim", "", "message_errors_total"),
+				Help: "Number of logged messages broken down by error code (451, 550, etc)",
+			},
+			[]string{"status", "enhanced"},
+		),
+		reject: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: prometheus.BuildFQName("exim", "", "reject_total"),
+				Help: "Total number of logged reject messages",
+			},
+		),
+	}
+}
+
+func (e *Exporter) ProcessMainLogLine(text string) {
+	logCounts.processMainLogLine(text)
+}
 
-		// Increment once more to get past the mail ID
+func (c *logCounters) processMainLogLine(text string) {
+	parts := strings.SplitN(text, " ", 7)
+	size := len(parts)
+	if size < 3 {
+		return
+	}
+
+	index := 2
+	// Handle logs when timestamps are enabled
+	if parts[index][0] == '+' || parts[index][0] == '-' {
 		index++
+	}
 
-		if size < index+1 {
-			continue
-		}
+	// Handle logs when PID logging is enabled
+	if parts[index][0] == '[' {
+		index++
+	}
 
-		errorFlag := false
-		switch parts[index] {
-		case "<=":
-			eximMessages.With(prometheus.Labels{"flag": "arrived"}).Inc()
-		case "(=":
-			eximMessages.With(prometheus.Labels{"flag": "fakereject"}).Inc()
-		case "=>":
-			eximMessages.With(prometheus.Labels{"flag": "delivered"}).Inc()
-		case "->":
-			eximMessages.With(prometheus.Labels{"flag": "additional"}).Inc()
-		case ">>":
-			eximMessages.With(prometheus.Labels{"flag": "cutthrough"}).Inc()
-		case "*>":
-			eximMessages.With(prometheus.Labels{"flag": "suppressed"}).Inc()
-		case "**":
-			eximMessages.With(prometheus.Labels{"flag": "failed"}).Inc()
-			errorFlag = true
-		case "==":
-			eximMessages.With(prometheus.Labels{"flag": "deferred"}).Inc()
-			errorFlag = true
-		case "Completed":
-			eximMessages.With(prometheus.Labels{"flag": "completed"}).Inc()
-		}
-		if errorFlag {
-			match := errorCodeRegexp.FindStringSubmatch(line.Text)
-			if len(match) > 0 {
-				eximMessageErrors.With(prometheus.Labels{"status": match[1], "enhanced": match[2]}).Inc()
-			}
+	// Increment once more to get past the mail ID
+	index++
+
+	if size < index+1 {
+		return
+	}
+
+	errorFlag := false
+	switch parts[index] {
+	case "<=":
+		c.messages.With(prometheus.Labels{"flag": "arrived"}).Inc()
+	case "(=":
+		c.messages.With(prometheus.Labels{"flag": "fakereject"}).Inc()
+	case "=>":
+		c.messages.With(prometheus.Labels{"flag": "delivered"}).Inc()
+	case "->":
+		c.messages.With(prometheus.Labels{"flag": "additional"}).Inc()
+	case ">>":
+		c.messages.With(prometheus.Labels{"flag": "cutthrough"}).Inc()
+	case "*>":
+		c.messages.With(prometheus.Labels{"flag": "suppressed"}).Inc()
+	case "**":
+		c.messages.With(prometheus.Labels{"flag": "failed"}).Inc()
+		errorFlag = true
+	case "==":
+		c.messages.With(prometheus.Labels{"flag": "deferred"}).Inc()
+		errorFlag = true
+	case "Completed":
+		c.messages.With(prometheus.Labels{"flag": "completed"}).Inc()
+	}
+	if errorFlag {
+		match := errorCodeRegexp.FindStringSubmatch(text)
+		if len(match) > 0 {
+			c.messageErrors.With(prometheus.Labels{"status": match[1], "enhanced": match[2]}).Inc()
 		}
 	}
 }
+
 func (e *Exporter) TailRejectLog(lines chan *tail.Line) {
 	for line := range lines {
 		if line.Err != nil {
@@ -456,6 +755,9 @@ func init() {
 	prometheus.MustRegister(eximPanic)
 	prometheus.MustRegister(eximMessageErrors)
 	prometheus.MustRegister(readErrors)
+	prometheus.MustRegister(eximQueueStateTimeoutErrors)
+	prometheus.MustRegister(eximQueueScanDuration)
+	prometheus.MustRegister(eximQueueScanErrors)
 }
 
 func main() {
@@ -463,7 +765,7 @@ func main() {
 	flag.AddFlags(kingpin.CommandLine, promlogConfig)
 	kingpin.Version(version.Print("exim_exporter"))
 	kingpin.HelpFlag.Short('h')
-	kingpin.Parse()
+	command := kingpin.Parse()
 	logger := promlog.New(promlogConfig)
 
 	_ = level.Info(logger).Log("msg", "Starting exim exporter", "version", version.Info())
@@ -479,6 +781,11 @@ func main() {
 		*paniclog = path.Join(*logPath, *paniclog)
 	}
 
+	if *queueCommand != "" && len(strings.Fields(*queueCommand)) == 0 {
+		_ = level.Error(logger).Log("msg", "Queue command is empty", "command", *queueCommand)
+		os.Exit(1)
+	}
+
 	exporter := NewExporter(
 		*mainlog,
 		*rejectlog,
@@ -488,9 +795,54 @@ func main() {
 		promlogConfig.Level.String(),
 		logger,
 	)
-	exporter.QueueSize()
+	if command == backfillCommand.FullCommand() {
+		if err := exporter.RunBackfill(); err != nil {
+			_ = level.Error(logger).Log("msg", "Backfill failed", "err", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *checkpointFile != "" {
+		exporter.checkpoint = LoadCheckpoint(*checkpointFile, logger)
+	}
+	var counterStore *CounterStore
+	if *stateFile != "" {
+		counterStore = NewCounterStore(*stateFile, logger, exporter.checkpoint)
+		counterStore.Restore()
+		go counterStore.Run(*stateInterval)
+	}
+	go exporter.checkpoint.Run(*checkpointEvery)
+	if *queueWatch && *queueCommand != "" {
+		_ = level.Warn(logger).Log("msg", "Not watching the spool, since the queue is read from --queue.command")
+	} else if *queueWatch {
+		if err := exporter.WatchSpool(*queueWatchResync); err != nil {
+			_ = level.Warn(logger).Log("msg", "Unable to watch spool, reading it on each scrape instead", "err", err)
+		}
+	}
+	exporter.ScanQueue()
+	if *queueScanInterval > 0 {
+		go exporter.RunQueueScanner(*queueScanInterval)
+	}
 	exporter.Start()
 	prometheus.MustRegister(exporter)
+	prometheus.MustRegister(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: prometheus.BuildFQName("exim", "", "queue_scan_age_seconds"),
+			Help: "Time since the last successful scan of the queue",
+		},
+		exporter.QueueScanAge,
+	))
+
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		_ = level.Info(logger).Log("msg", "Shutting down")
+		counterStore.Save()
+		exporter.checkpoint.Save()
+		os.Exit(0)
+	}()
 
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		_, err := w.Write([]byte(`<html>
@@ -506,6 +858,9 @@ func main() {
 		}
 	})
 	http.Handle(*metricsPath, promhttp.Handler())
+	if *webQueueAPI {
+		http.HandleFunc("/api/v1/queue", exporter.ServeQueueAPI)
+	}
 
 	_ = level.Info(logger).Log("msg", "Listening", "address", listenAddress)
 	server := &http.Server{}
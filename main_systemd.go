@@ -28,15 +28,11 @@ func (e *Exporter) JournalTail(identifier string, priority syslog.Priority) chan
 		_ = level.Error(e.logger).Log("msg", "Could not setup syslog identifier journal match", "err", err)
 		os.Exit(1)
 	}
-	if err := j.SeekTail(); err != nil {
-		_ = level.Error(e.logger).Log("msg", "Could not seek to journal tail", "err", err)
-		os.Exit(1)
-	}
-	// Apparently we need to go one back to avoid getting older entries from before we start.
-	// This looks like a bug in the library.
-	if _, err := j.Previous(); err != nil {
-		_ = level.Error(e.logger).Log("msg", "Could not advance one journal entry", "err", err)
-		os.Exit(1)
+	key := fmt.Sprintf("journal:%s:%d", identifier, priority)
+	if cursor := e.checkpoint.Cursor(key); cursor != "" {
+		e.seekJournalCursor(j, cursor)
+	} else {
+		e.seekJournalTail(j)
 	}
 
 	lines := make(chan *tail.Line)
@@ -78,7 +74,57 @@ func (e *Exporter) JournalTail(identifier string, priority syslog.Priority) chan
 				Text: text,
 				Time: time.Unix(int64(je.RealtimeTimestamp/10e6), int64(je.RealtimeTimestamp%10e6*1000)),
 			}
+			e.checkpoint.UpdateCursor(key, je.Cursor)
 		}
 	}()
 	return lines
 }
+
+func (e *Exporter) seekJournalTail(j *sdjournal.Journal) {
+	if err := j.SeekTail(); err != nil {
+		_ = level.Error(e.logger).Log("msg", "Could not seek to journal tail", "err", err)
+		os.Exit(1)
+	}
+	// Apparently we need to go one back to avoid getting older entries from before we start.
+	// This looks like a bug in the library.
+	if _, err := j.Previous(); err != nil {
+		_ = level.Error(e.logger).Log("msg", "Could not advance one journal entry", "err", err)
+		os.Exit(1)
+	}
+}
+
+// seekJournalCursor positions the journal on the last entry read before the exporter was stopped, so reading continues
+// with the entry after it. Entries older than --tail.checkpoint-max-age are skipped.
+func (e *Exporter) seekJournalCursor(j *sdjournal.Journal, cursor string) {
+	if err := j.SeekCursor(cursor); err != nil {
+		_ = level.Warn(e.logger).Log("msg", "Could not seek to checkpointed journal cursor, starting from the tail", "err", err)
+		e.seekJournalTail(j)
+		return
+	}
+	if _, err := j.Next(); err != nil {
+		_ = level.Warn(e.logger).Log("msg", "Could not read checkpointed journal entry, starting from the tail", "err", err)
+		e.seekJournalTail(j)
+		return
+	}
+	usec, err := j.GetRealtimeUsec()
+	if err := j.TestCursor(cursor); err != nil {
+		_ = level.Warn(e.logger).Log("msg", "Checkpointed journal entry no longer exists, entries may have been missed")
+		// This is already the entry after it, which would be skipped by moving on from it, so the cursor is sought
+		// again for the next entry read to be this one.
+		if err := j.SeekCursor(cursor); err != nil {
+			_ = level.Warn(e.logger).Log("msg", "Could not seek to checkpointed journal cursor, starting from the tail", "err", err)
+			e.seekJournalTail(j)
+			return
+		}
+	}
+	oldest := time.Now().Add(-*checkpointMaxAge)
+	if *checkpointMaxAge == 0 || err != nil || time.UnixMicro(int64(usec)).After(oldest) {
+		_ = level.Info(e.logger).Log("msg", "Resuming journal from checkpoint")
+		return
+	}
+	_ = level.Warn(e.logger).Log("msg", "Skipping journal entries older than the replay limit")
+	if err := j.SeekRealtimeUsec(uint64(oldest.UnixMicro())); err != nil {
+		_ = level.Warn(e.logger).Log("msg", "Could not seek journal, starting from the tail", "err", err)
+		e.seekJournalTail(j)
+	}
+}
@@ -1,13 +1,30 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"github.com/alecthomas/units"
+	"github.com/klauspost/compress/zstd"
+	"github.com/nxadm/tail"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/prometheus/common/promlog"
+	"io"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -140,6 +157,14 @@ func appendLog(name string, file *os.File, t *testing.T) {
 
 func TestMetrics(t *testing.T) {
 	logger := promlog.New(&promlog.Config{})
+	timeNow = func() time.Time { return time.Unix(1707900000, 0) }
+	defer func() { timeNow = time.Now }()
+	statfs = func(path string, stat *syscall.Statfs_t) error {
+		*stat = syscall.Statfs_t{Bsize: 4096, Blocks: 262144, Bavail: 131072, Files: 65536, Ffree: 32768}
+		return nil
+	}
+	defer func() { statfs = syscall.Statfs }()
+	defer func(get func() ([]*Process, error)) { getProcesses = get }(getProcesses)
 
 	// Create a temp dir for our mock data
 	tempPath, err := os.MkdirTemp("", "exim_exporter_test")
@@ -206,7 +231,7 @@ func TestMetrics(t *testing.T) {
 	}
 	getProcesses = func() ([]*Process, error) {
 		return []*Process{
-			{[]string{"/bin/bash", "-x"}, false},
+			{cmdline: []string{"/bin/bash", "-x"}, leader: false},
 		}, nil
 	}
 	t.Run("down", func(t *testing.T) {
@@ -224,7 +249,7 @@ func TestMetrics(t *testing.T) {
 	}
 	getProcesses = func() ([]*Process, error) {
 		return []*Process{
-			{[]string{"/usr/sbin/exim4", "-ps", "-bd", "-q15m", "-oP", "/var/spool/exim/exim-daemon.pid"}, true},
+			{cmdline: []string{"/usr/sbin/exim4", "-ps", "-bd", "-q15m", "-oP", "/var/spool/exim/exim-daemon.pid"}, leader: true, started: time.Unix(1707900000-259200, 0), cpuSeconds: 12.5, rss: 8388608, fds: 9},
 		}, nil
 	}
 	t.Run("daemon", func(t *testing.T) {
@@ -232,16 +257,17 @@ func TestMetrics(t *testing.T) {
 	})
 	getProcesses = func() ([]*Process, error) {
 		return []*Process{
-			{[]string{"/bin/bash", "-x"}, false},
-			{[]string{"/usr/sbin/exim4"}, false},
-			{[]string{"/usr/sbin/exim4", "-q30m"}, false},
-			{[]string{"/usr/sbin/exim4", "-bd"}, true},
-			{[]string{"/usr/sbin/exim4", "-qG"}, false},
-			{[]string{"/usr/sbin/exim4", "-Mc", "1jofsL-0006tb-8D"}, false},
-			{[]string{"/usr/sbin/exim4", "-Mc", "1jofsL-0006tb-8D"}, false},
-			{[]string{"/usr/sbin/exim4", "-bd"}, false},
-			{[]string{"/usr/sbin/exim4", "-bd"}, false},
-			{[]string{"/usr/sbin/exim4", "-bd"}, false},
+			{cmdline: []string{"/bin/bash", "-x"}, leader: false},
+			{cmdline: []string{"/usr/sbin/exim4"}, leader: false},
+			{cmdline: []string{"/usr/sbin/exim4", "-q30m"}, leader: false},
+			{cmdline: []string{"/usr/sbin/exim4", "-bd"}, leader: true, started: time.Unix(1707900000-259200, 0), cpuSeconds: 12.5, rss: 8388608, fds: 9},
+			{cmdline: []string{"/usr/sbin/exim4", "-qG"}, leader: false},
+			{cmdline: []string{"/usr/sbin/exim4", "-qGbulk/5m"}, leader: false},
+			{cmdline: []string{"/usr/sbin/exim4", "-Mc", "1jofsL-0006tb-8D"}, leader: false, started: time.Unix(1707900000-30, 0), cpuSeconds: 0.25, rss: 4194304, fds: 7},
+			{cmdline: []string{"/usr/sbin/exim4", "-Mc", "1jofsL-0006tb-8D"}, leader: false, started: time.Unix(1707900000-7260, 0), cpuSeconds: 120, rss: 536870912, fds: 12},
+			{cmdline: []string{"/usr/sbin/exim4", "-bd"}, leader: false, started: time.Unix(1707900000-5, 0)},
+			{cmdline: []string{"/usr/sbin/exim4", "-bd"}, leader: false, started: time.Unix(1707900000-600, 0)},
+			{cmdline: []string{"/usr/sbin/exim4", "-bd"}, leader: false},
 		}, nil
 	}
 	t.Run("up", func(t *testing.T) {
@@ -266,3 +292,1506 @@ func TestMetrics(t *testing.T) {
 		collectAndCompareTestCase("update", registry, t)
 	})
 }
+
+func TestResolveLogPath(t *testing.T) {
+	now := time.Date(2026, 10, 17, 23, 59, 59, 0, time.Local)
+	for template, expected := range map[string]string{
+		"/var/log/exim4/mainlog":       "/var/log/exim4/mainlog",
+		"/var/log/exim4/mainlog-%D":    "/var/log/exim4/mainlog-20261017",
+		"/var/log/exim4/%M/mainlog-%D": "/var/log/exim4/202610/mainlog-20261017",
+	} {
+		if actual := resolveLogPath(template, now); actual != expected {
+			t.Errorf("resolveLogPath(%q) = %q, expected %q", template, actual, expected)
+		}
+	}
+}
+
+func TestDatestampedFileTail(t *testing.T) {
+	tempPath, err := os.MkdirTemp("", "exim_exporter_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(tempPath) }()
+
+	// The tail keeps running after the test, so fall back to the real clock rather than replacing timeNow again.
+	var now atomic.Value
+	now.Store(time.Date(2026, 10, 17, 23, 59, 59, 0, time.Local))
+	timeNow = func() time.Time {
+		if t := now.Load().(time.Time); !t.IsZero() {
+			return t
+		}
+		return time.Now()
+	}
+	datestampCheckInterval = 10 * time.Millisecond
+	defer func() {
+		now.Store(time.Time{})
+		datestampCheckInterval = 10 * time.Second
+	}()
+
+	appendLine := func(name, text string) {
+		fh, err := os.OpenFile(filepath.Join(tempPath, name), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = fh.Close() }()
+		if _, err := fh.WriteString(text + "\n"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectLine := func(lines chan *tail.Line, text string) {
+		select {
+		case line := <-lines:
+			if line.Text != text {
+				t.Fatalf("Read %q, expected %q", line.Text, text)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for %q", text)
+		}
+	}
+
+	appendLine("mainlog-20261017", "old")
+	exporter := NewExporter("", "", "", "exim4", "", "error", promlog.New(&promlog.Config{}))
+	lines := exporter.FileTail(filepath.Join(tempPath, "mainlog-%D"))
+	// Give the tail a moment to seek to the end before writing
+	time.Sleep(100 * time.Millisecond)
+	appendLine("mainlog-20261017", "first")
+	expectLine(lines, "first")
+
+	now.Store(time.Date(2026, 10, 18, 0, 0, 1, 0, time.Local))
+	appendLine("mainlog-20261017", "late")
+	appendLine("mainlog-20261018", "second")
+	expectLine(lines, "late")
+	expectLine(lines, "second")
+}
+
+func TestCheckpointResume(t *testing.T) {
+	tempPath, err := os.MkdirTemp("", "exim_exporter_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(tempPath) }()
+	filename := filepath.Join(tempPath, "mainlog")
+	if err := os.WriteFile(filename, []byte("read\nmissed\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	logger := promlog.New(&promlog.Config{})
+	checkpoint := LoadCheckpoint(filepath.Join(tempPath, "checkpoint.json"), logger)
+	checkpoint.Start(filename, filename, int64(len("read\n")))
+	checkpoint.Save()
+
+	// Rotate the log while the exporter is "stopped"
+	if err := os.Rename(filename, filename+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filename, []byte("rotated\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	exporter := NewExporter(filename, "", "", "exim4", "", "error", logger)
+	exporter.checkpoint = LoadCheckpoint(filepath.Join(tempPath, "checkpoint.json"), logger)
+	lines := exporter.FileTail(filename)
+	for _, expected := range []string{"missed", "rotated"} {
+		select {
+		case line := <-lines:
+			if line.Text != expected {
+				t.Fatalf("Read %q, expected %q", line.Text, expected)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for %q", expected)
+		}
+	}
+	// The position is updated once the line has been handed over
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		pos := exporter.checkpoint.Position(filename)
+		if pos != nil && pos.Filename == filename && pos.Offset == int64(len("rotated\n")) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Unexpected checkpoint position %+v", pos)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCheckpointSafeguards(t *testing.T) {
+	defer func(maxReplay units.Base2Bytes) { *checkpointMaxReplay = maxReplay }(*checkpointMaxReplay)
+	logger := promlog.New(&promlog.Config{})
+	for _, test := range []struct {
+		name      string
+		maxReplay units.Base2Bytes
+		offset    int64
+		// Changes the log after the checkpoint was saved
+		change   func(filename string) error
+		expected string
+	}{
+		{
+			name:   "truncated",
+			offset: 100,
+			change: func(filename string) error {
+				return os.WriteFile(filename, []byte("truncated\n"), 0644)
+			},
+			expected: "truncated",
+		},
+		{
+			// The backlog is larger than the limit, so reading starts at the line after the limit
+			name:      "max replay",
+			maxReplay: 7,
+			expected:  "dddd",
+		},
+		{
+			// The limit falls on the start of a line, which is kept
+			name:      "max replay aligned",
+			maxReplay: 10,
+			expected:  "cccc",
+		},
+		{
+			// The checkpointed file was rotated away and removed, so the new one is read from the start
+			name:   "missing rotated",
+			offset: 5,
+			change: func(filename string) error {
+				if err := os.WriteFile(filename+".new", []byte("new\n"), 0644); err != nil {
+					return err
+				}
+				return os.Rename(filename+".new", filename)
+			},
+			expected: "new",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			tempPath, err := os.MkdirTemp("", "exim_exporter_test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = os.RemoveAll(tempPath) }()
+			filename := filepath.Join(tempPath, "mainlog")
+			if err := os.WriteFile(filename, []byte("aaaa\nbbbb\ncccc\ndddd\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			checkpoint := LoadCheckpoint(filepath.Join(tempPath, "checkpoint.json"), logger)
+			checkpoint.Start(filename, filename, test.offset)
+			checkpoint.Save()
+			if test.change != nil {
+				if err := test.change(filename); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			*checkpointMaxReplay = test.maxReplay
+			exporter := NewExporter(filename, "", "", "exim4", "", "error", logger)
+			exporter.checkpoint = LoadCheckpoint(filepath.Join(tempPath, "checkpoint.json"), logger)
+			lines := exporter.FileTail(filename)
+			select {
+			case line := <-lines:
+				if line.Text != test.expected {
+					t.Fatalf("Read %q, expected %q", line.Text, test.expected)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Timed out waiting for %q", test.expected)
+			}
+		})
+	}
+}
+
+func TestReplayCompressed(t *testing.T) {
+	gzipped := func(data []byte) []byte {
+		var compressed bytes.Buffer
+		writer := gzip.NewWriter(&compressed)
+		_, _ = writer.Write(data)
+		_ = writer.Close()
+		return compressed.Bytes()
+	}
+	zstded := func(data []byte) []byte {
+		var compressed bytes.Buffer
+		writer, _ := zstd.NewWriter(&compressed)
+		_, _ = writer.Write(data)
+		_ = writer.Close()
+		return compressed.Bytes()
+	}
+	logger := promlog.New(&promlog.Config{})
+	for _, test := range []struct {
+		name     string
+		rotated  string
+		compress func([]byte) []byte
+	}{
+		{"numbered gzip", "mainlog.1.gz", gzipped},
+		{"dateext zstd", "mainlog-20261018.zst", zstded},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			tempPath, err := os.MkdirTemp("", "exim_exporter_test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = os.RemoveAll(tempPath) }()
+			filename := filepath.Join(tempPath, "mainlog")
+			data := []byte("read\nmissed\nalso missed\n")
+			if err := os.WriteFile(filename, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			checkpoint := LoadCheckpoint(filepath.Join(tempPath, "checkpoint.json"), logger)
+			checkpoint.Start(filename, filename, int64(len("read\n")))
+			checkpoint.Save()
+
+			// The log is rotated and compressed into a new file while the exporter is "stopped", next to another
+			// compressed log which isn't the one that was being read
+			if err := os.WriteFile(filepath.Join(tempPath, "mainlog.2.gz"), gzipped([]byte("older\n")), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Rename(filename, filename+".1"); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filename, []byte("rotated\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(tempPath, test.rotated), test.compress(data), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Remove(filename + ".1"); err != nil {
+				t.Fatal(err)
+			}
+
+			exporter := NewExporter(filename, "", "", "exim4", "", "error", logger)
+			exporter.checkpoint = LoadCheckpoint(filepath.Join(tempPath, "checkpoint.json"), logger)
+			lines := exporter.FileTail(filename)
+			for _, expected := range []string{"missed", "also missed", "rotated"} {
+				select {
+				case line := <-lines:
+					if line.Text != expected {
+						t.Fatalf("Read %q, expected %q", line.Text, expected)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("Timed out waiting for %q", expected)
+				}
+			}
+		})
+	}
+}
+
+func TestCounterStore(t *testing.T) {
+	tempPath, err := os.MkdirTemp("", "exim_exporter_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(tempPath) }()
+	logger := promlog.New(&promlog.Config{})
+	// Counters of their own, so the totals served by TestMetrics aren't changed
+	counters := newLogCounters()
+	checkpoint := LoadCheckpoint(filepath.Join(tempPath, "checkpoint.json"), logger)
+	store := NewCounterStore(filepath.Join(tempPath, "state.json"), logger, checkpoint)
+	store.counters = map[string]persistedCounter{
+		"exim_messages_total": {counters.messages, []string{"flag"}},
+		"exim_reject_total":   {counters.reject, []string{}},
+	}
+
+	counters.reject.Add(3)
+	counters.messages.With(prometheus.Labels{"flag": "arrived"}).Add(2)
+	checkpoint.Update("mainlog", filepath.Join(tempPath, "mainlog"), 100)
+	store.Save()
+	// The checkpoint moves on, and is saved, but the counters aren't
+	checkpoint.Update("mainlog", filepath.Join(tempPath, "mainlog"), 200)
+	checkpoint.Save()
+	checkpoint = LoadCheckpoint(filepath.Join(tempPath, "checkpoint.json"), logger)
+	store.checkpoint = checkpoint
+	store.Restore()
+	// Reading resumes from where the counters were saved
+	if pos := checkpoint.Position("mainlog"); pos == nil || pos.Offset != 100 {
+		t.Errorf("Restored position %+v, expected offset 100", pos)
+	}
+	if actual := testutil.ToFloat64(counters.reject); actual != 6 {
+		t.Errorf("exim_reject_total = %v, expected 6", actual)
+	}
+	if actual := testutil.ToFloat64(counters.messages.With(prometheus.Labels{"flag": "arrived"})); actual != 4 {
+		t.Errorf("exim_messages_total = %v, expected 4", actual)
+	}
+
+	// Counters saved with a different label schema or version are not restored
+	for _, state := range []string{
+		`{"version":1,"counters":{"exim_reject_total":{"labels":["type"],"samples":[{"labels":{"type":"x"},"value":1}]}}}`,
+		`{"version":0,"counters":{"exim_reject_total":{"labels":[],"samples":[{"labels":{},"value":1}]}}}`,
+	} {
+		if err := os.WriteFile(filepath.Join(tempPath, "state.json"), []byte(state), 0644); err != nil {
+			t.Fatal(err)
+		}
+		store.Restore()
+		if actual := testutil.ToFloat64(counters.reject); actual != 6 {
+			t.Errorf("exim_reject_total = %v, expected 6", actual)
+		}
+	}
+}
+
+func TestBackfill(t *testing.T) {
+	tempPath, err := os.MkdirTemp("", "exim_exporter_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(tempPath) }()
+	data, err := os.ReadFile(filepath.Join("test", "rejectlog"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := os.Create(filepath.Join(tempPath, "rejectlog.1.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := gzip.NewWriter(rotated)
+	_, _ = writer.Write(data)
+	_ = writer.Close()
+	_ = rotated.Close()
+	if err := os.WriteFile(filepath.Join(tempPath, "rejectlog"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	rejectlogs := rotatedLogs(filepath.Join(tempPath, "rejectlog"))
+	if len(rejectlogs) != 2 || filepath.Base(rejectlogs[0]) != "rejectlog.1.gz" {
+		t.Fatalf("Unexpected rotated logs %v", rejectlogs)
+	}
+
+	exporter := NewExporter("", "", "", "exim4", "", "error", promlog.New(&promlog.Config{}))
+	before := testutil.ToFloat64(eximReject)
+	var out strings.Builder
+	err = exporter.Backfill([]string{filepath.Join("test", "mainlog")}, rejectlogs, time.Hour, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if lines[len(lines)-1] != "# EOF" {
+		t.Fatal("Missing # EOF")
+	}
+	var last string
+	for _, line := range lines {
+		if strings.HasPrefix(line, "exim_reject_total ") {
+			last = line
+		}
+	}
+	expected := fmt.Sprintf("exim_reject_total %.1f ", float64(2*strings.Count(string(data), "\n")))
+	if !strings.HasPrefix(last, expected) {
+		t.Fatalf("Last sample %q, expected %q", last, expected)
+	}
+	// The running exporter's counters are left alone
+	if actual := testutil.ToFloat64(eximReject); actual != before {
+		t.Fatalf("exim_reject_total = %v after backfill, expected %v", actual, before)
+	}
+
+	// With enough samples for them to be written out to temporary files, those of each series are still grouped
+	// together in order of time
+	out.Reset()
+	if err := exporter.Backfill([]string{filepath.Join("test", "mainlog")}, rejectlogs, time.Minute, &out); err != nil {
+		t.Fatal(err)
+	}
+	finished := make(map[string]bool)
+	written, writtenOut := 0, false
+	var series string
+	var timestamp float64
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		sampleTime, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fields[0] != series {
+			if finished[fields[0]] {
+				t.Fatalf("Samples of %s aren't grouped together", fields[0])
+			}
+			finished[series] = true
+			series = fields[0]
+			written = 0
+		} else if sampleTime <= timestamp {
+			t.Fatalf("Samples of %s aren't in order of time", series)
+		}
+		timestamp = sampleTime
+		written += len(line) + 1
+		writtenOut = writtenOut || written > backfillBufferSize
+	}
+	if !writtenOut {
+		t.Fatal("No series had enough samples to be written out")
+	}
+}
+
+func TestOpenLog(t *testing.T) {
+	tempPath, err := os.MkdirTemp("", "exim_exporter_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(tempPath) }()
+	expected, err := os.ReadFile(filepath.Join("test", "rejectlog"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gzipped, zstded bytes.Buffer
+	gzipWriter := gzip.NewWriter(&gzipped)
+	_, _ = gzipWriter.Write(expected)
+	_ = gzipWriter.Close()
+	zstdWriter, _ := zstd.NewWriter(&zstded)
+	_, _ = zstdWriter.Write(expected)
+	_ = zstdWriter.Close()
+	bzipped, err := os.ReadFile(filepath.Join("test", "rejectlog.bz2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, data := range map[string][]byte{
+		"rejectlog":     expected,
+		"rejectlog.gz":  gzipped.Bytes(),
+		"rejectlog.bz2": bzipped,
+		// Detected by magic bytes despite the extension
+		"rejectlog.2": zstded.Bytes(),
+	} {
+		filename := filepath.Join(tempPath, name)
+		if err := os.WriteFile(filename, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		reader, err := openLog(filename)
+		if err != nil {
+			t.Fatalf("Unable to open %s: %s", name, err)
+		}
+		actual, err := io.ReadAll(reader)
+		_ = reader.Close()
+		if err != nil {
+			t.Fatalf("Unable to read %s: %s", name, err)
+		}
+		if !bytes.Equal(actual, expected) {
+			t.Errorf("Unexpected contents of %s: %q", name, actual)
+		}
+	}
+}
+
+// tempInputPath creates an input directory in a temporary spool directory, so named queues aren't looked for elsewhere.
+func tempInputPath(t *testing.T) string {
+	spoolPath, err := os.MkdirTemp("", "exim_exporter_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(spoolPath) })
+	inputPath := filepath.Join(spoolPath, "input")
+	if err := os.Mkdir(inputPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	return inputPath
+}
+
+func TestQueueSizeCache(t *testing.T) {
+	tempPath := tempInputPath(t)
+	if err := copySampleInput(tempPath); err != nil {
+		t.Fatal("Unable to copy sample input:", err)
+	}
+	exporter := NewExporter("", "", "", "exim4", tempPath, "error", promlog.New(&promlog.Config{}))
+	defer func(timeout time.Duration) { *frozenTimeout = timeout }(*frozenTimeout)
+
+	// Headers which couldn't be read before the timeout are read on the next scrape
+	*frozenTimeout = time.Nanosecond
+	if queue, _ := exporter.QueueSize(); queue.Queue("").total != 2 || queue.Queue("").frozen != 0 || !queue.timedOut {
+		t.Fatalf("Unexpected queue size %+v", queue)
+	}
+	*frozenTimeout = 0
+	if queue, _ := exporter.QueueSize(); queue.Queue("").total != 2 || queue.Queue("").frozen != 1 || queue.timedOut {
+		t.Fatalf("Unexpected queue size %+v", queue)
+	}
+
+	// Headers are read again when they change
+	header := filepath.Join(tempPath, "1rZeE0-00GmsY-CG-H")
+	data, err := os.ReadFile(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	thawed := strings.Replace(string(data), "-frozen 1707774748\n", "", 1)
+	if err := os.WriteFile(header+".tmp", []byte(thawed), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(header+".tmp", header); err != nil {
+		t.Fatal(err)
+	}
+	if queue, _ := exporter.QueueSize(); queue.Queue("").total != 2 || queue.Queue("").frozen != 0 {
+		t.Fatalf("Unexpected queue size %+v", queue)
+	}
+
+	// Removed messages are forgotten
+	if err := os.Remove(header); err != nil {
+		t.Fatal(err)
+	}
+	if queue, _ := exporter.QueueSize(); queue.Queue("").total != 1 || len(exporter.spool.messages) != 1 {
+		t.Fatalf("Unexpected queue size %+v", queue)
+	}
+}
+
+func TestWatchSpool(t *testing.T) {
+	tempPath := tempInputPath(t)
+	if err := copySampleInput(tempPath); err != nil {
+		t.Fatal("Unable to copy sample input:", err)
+	}
+	exporter := NewExporter("", "", "", "exim4", tempPath, "error", promlog.New(&promlog.Config{}))
+	if err := exporter.WatchSpool(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	waitForQueue := func(total float64) {
+		t.Helper()
+		for i := 0; i < 100; i++ {
+			if queue, _ := exporter.QueueSize(); queue.Queue("").total == total {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("Queue size never reached %v", total)
+	}
+	// The orphaned files and directory sizes are kept up to date as well
+	waitForFiles := func(orphanedHeaders, orphanedData float64, directories map[string]float64) {
+		t.Helper()
+		var stats QueueStats
+		for i := 0; i < 100; i++ {
+			queue, _ := exporter.QueueSize()
+			stats = queue.Queue("")
+			if stats.orphanedHeaders == orphanedHeaders && stats.orphanedData == orphanedData && reflect.DeepEqual(stats.directories, directories) {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("Unexpected orphaned files %v %v and directories %v", stats.orphanedHeaders, stats.orphanedData, stats.directories)
+	}
+	waitForQueue(2)
+	waitForFiles(0, 0, map[string]float64{".": 4})
+
+	// Exim rewrites headers by renaming a temporary file over them, which doesn't add a directory entry
+	data, err := os.ReadFile(filepath.Join(tempPath, "1rZeE0-00GmsY-CG-H"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		temp := filepath.Join(tempPath, "hdr.1rZeE0-00GmsY-CG")
+		if err := os.WriteFile(temp, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(temp, filepath.Join(tempPath, "1rZeE0-00GmsY-CG-H")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForQueue(2)
+	waitForFiles(0, 0, map[string]float64{".": 4})
+
+	// Messages queued in a new hash directory are picked up once it is watched
+	hashPath := filepath.Join(tempPath, "Y")
+	if err := os.Mkdir(hashPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(hashPath, "1rZeE0-00GmsY-CH-H"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitForQueue(3)
+	waitForFiles(1, 0, map[string]float64{".": 5, "Y": 1})
+	if err := os.WriteFile(filepath.Join(hashPath, "1rZeE0-00GmsY-CH-D"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitForFiles(0, 0, map[string]float64{".": 5, "Y": 2})
+
+	if err := os.Remove(filepath.Join(tempPath, "1rZeE0-00GmsY-CG-H")); err != nil {
+		t.Fatal(err)
+	}
+	waitForQueue(2)
+	waitForFiles(0, 1, map[string]float64{".": 4, "Y": 2})
+	if err := os.Remove(filepath.Join(tempPath, "1rZeE0-00GmsY-CG-D")); err != nil {
+		t.Fatal(err)
+	}
+	waitForFiles(0, 0, map[string]float64{".": 3, "Y": 2})
+}
+
+func TestScanQueue(t *testing.T) {
+	tempPath := tempInputPath(t)
+	if err := copySampleInput(tempPath); err != nil {
+		t.Fatal("Unable to copy sample input:", err)
+	}
+	exporter := NewExporter("", "", "", "exim4", tempPath, "error", promlog.New(&promlog.Config{}))
+	if queue := exporter.ScanQueue(); queue.Queue("").total != 2 {
+		t.Fatalf("Unexpected queue size %+v", queue)
+	}
+
+	// Failed scans are counted, and the last successful result is kept
+	errors := testutil.ToFloat64(eximQueueScanErrors)
+	if err := os.RemoveAll(tempPath); err != nil {
+		t.Fatal(err)
+	}
+	if queue := exporter.ScanQueue(); queue.Queue("").total != 2 {
+		t.Fatalf("Unexpected queue size %+v", queue)
+	}
+	if queue := exporter.CachedQueue(); queue.Queue("").total != 2 {
+		t.Fatalf("Unexpected queue size %+v", queue)
+	}
+	if value := testutil.ToFloat64(eximQueueScanErrors); value != errors+1 {
+		t.Fatalf("Expected %v scan errors, got %v", errors+1, value)
+	}
+}
+
+func TestQueueSizeConcurrency(t *testing.T) {
+	tempPath := tempInputPath(t)
+	if err := buildMockInput(tempPath); err != nil {
+		t.Fatal("Unable to build mock input:", err)
+	}
+	if err := copySampleInput(tempPath); err != nil {
+		t.Fatal("Unable to copy sample input:", err)
+	}
+	timeNow = func() time.Time { return time.Unix(1707900000, 0) }
+	defer func() { timeNow = time.Now }()
+	defer func(concurrency int) { *queueConcurrency = concurrency }(*queueConcurrency)
+
+	logger := promlog.New(&promlog.Config{})
+	*queueConcurrency = 1
+	sequential, err := NewExporter("", "", "", "exim4", tempPath, "error", logger).QueueSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sequential.Queue("").total <= 2 {
+		t.Fatalf("Hash directories weren't scanned: %+v", sequential)
+	}
+	*queueConcurrency = 8
+	concurrent, err := NewExporter("", "", "", "exim4", tempPath, "error", logger).QueueSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(sequential, concurrent) {
+		t.Fatalf("Concurrent scan %+v differs from sequential scan %+v", concurrent, sequential)
+	}
+}
+
+func TestNamedQueues(t *testing.T) {
+	tempPath := tempInputPath(t)
+	if err := copySampleInput(tempPath); err != nil {
+		t.Fatal("Unable to copy sample input:", err)
+	}
+	spoolPath := filepath.Dir(tempPath)
+	data, err := os.ReadFile(filepath.Join(tempPath, "1rZeE0-00GmsY-CG-H"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dirname := range []string{"bulk/input/H", "empty/input", "msglog"} {
+		if err := os.MkdirAll(filepath.Join(spoolPath, dirname), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(spoolPath, "bulk/input/H/1rZeE0-00GmsH-CG-H"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	exporter := NewExporter("", "", "", "exim4", tempPath, "error", promlog.New(&promlog.Config{}))
+	queue, err := exporter.QueueSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queue.queues) != 3 {
+		t.Fatalf("Expected the default, bulk and empty queues, got %+v", queue.queues)
+	}
+	if stats := queue.Queue(""); stats.total != 2 || stats.frozen != 1 {
+		t.Fatalf("Unexpected default queue size %+v", stats)
+	}
+	if stats := queue.Queue("bulk"); stats.total != 1 || stats.frozen != 1 {
+		t.Fatalf("Unexpected bulk queue size %+v", stats)
+	}
+	if stats, ok := queue.queues["empty"]; !ok || stats.total != 0 {
+		t.Fatalf("Unexpected empty queue size %+v", stats)
+	}
+}
+
+func TestParseSpoolHeader(t *testing.T) {
+	// The headers in test/spool have lengths matching them, as written by Exim
+	header, err := ReadSpoolHeader(filepath.Join("test", "spool", "1rZeE0-00GmsY-CG-H"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.ID != "1rZeE0-00GmsY-CG" || header.Login != "Debian-exim" || header.UID != 115 || header.GID != 120 {
+		t.Fatalf("Unexpected identity %+v", header)
+	}
+	if header.Sender != "" || !header.Received.Equal(time.Unix(1707774748, 380417000)) || header.WarningCount != 0 {
+		t.Fatalf("Unexpected envelope %+v", header)
+	}
+	if !header.Frozen || !header.FrozenAt.Equal(time.Unix(1707774748, 0)) || !header.LocalError || header.BodyLineCount != 1463 {
+		t.Fatalf("Unexpected variables %+v", header)
+	}
+	if value, ok := header.Variables["allow_unqualified_sender"]; !ok || value != "" {
+		t.Fatalf("Unexpected variables %+v", header.Variables)
+	}
+	if len(header.NonRecipients) != 0 || len(header.Recipients) != 1 || header.Recipients[0].Address != "postmaster@junk.bogus" {
+		t.Fatalf("Unexpected recipients %+v %+v", header.NonRecipients, header.Recipients)
+	}
+	if len(header.Headers) != 11 || header.Headers[0].Type != 'P' || header.Headers[1].Type != ' ' {
+		t.Fatalf("Unexpected headers %+v", header.Headers)
+	}
+	if header.Headers[0].Text != "Received: from Debian-exim by mta.bogus with local (Exim 4.93)\n\tid 1rZeE0-00GmsY-CG\n\tfor postmaster@junk.bogus; Mon, 12 Feb 2024 13:52:28 -0800\n" {
+		t.Fatalf("Unexpected header %q", header.Headers[0].Text)
+	}
+	for _, line := range header.Headers {
+		if line.Mismatched {
+			t.Fatalf("Unexpected length mismatch %+v", line)
+		}
+	}
+
+	// The sample input was edited after being written by Exim, without updating the lengths, which is tolerated
+	edited, err := ReadSpoolHeader(filepath.Join("test", "input", "1rZeE0-00GmsY-CG-H"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(edited.Headers) != len(header.Headers) {
+		t.Fatalf("Unexpected headers %+v", edited.Headers)
+	}
+	mismatched := 0
+	for i, line := range edited.Headers {
+		if line.Text != header.Headers[i].Text || line.Type != header.Headers[i].Type {
+			t.Fatalf("Unexpected header %+v, expected %+v", line, header.Headers[i])
+		}
+		if line.Mismatched {
+			mismatched++
+		}
+	}
+	if mismatched != 6 {
+		t.Fatalf("%d mismatched headers, expected 6", mismatched)
+	}
+
+	// The file ends without a newline after the last header
+	header, err = ReadSpoolHeader(filepath.Join("test", "spool", "1ra7OS-004XaW-CD-H"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Frozen || header.HostAddress != "192.0.0.1.58573" || header.ReceivedProtocol != "esmtp" {
+		t.Fatalf("Unexpected variables %+v", header)
+	}
+	if header.Variables["helo_name"] != "host.bogus" || !header.Tainted["helo_name"] || header.Tainted["host_address"] {
+		t.Fatalf("Unexpected tainted variables %+v", header.Tainted)
+	}
+	if last := header.Headers[len(header.Headers)-1]; last.Text != "Auto-Submitted: auto-replied\n" || last.Mismatched {
+		t.Fatalf("Unexpected last header %+v", last)
+	}
+	edited, err = ReadSpoolHeader(filepath.Join("test", "input", "1ra7OS-004XaW-CD-H"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(edited.Headers) != len(header.Headers) || edited.Headers[len(edited.Headers)-1].Text != "Auto-Submitted: auto-replied\n" {
+		t.Fatalf("Unexpected headers %+v", edited.Headers)
+	}
+
+	header, err = ParseSpoolHeader(strings.NewReader(`1rZeE0-00GmsY-CH-H
+exim 93 93
+<sender@example.com>
+1707774748 2
+-aclc 0 3
+a
+b
+-aclm _verified 2
+ok
+-host_auth plain
+-tls_cipher TLS1.3:TLS_AES_256_GCM_SHA384:256
+-deliver_firsttime
+-manual_thaw
+-N
+YY one@example.com
+NN two@example.com
+NN three@example.com
+4
+one@example.com
+two@example.com
+three@example.com
+four@example.com rfc822;Four@Example.com 23,10 errors@example.com 18,-1#3
+
+000  Subject: test
+`))
+	if err == nil {
+		t.Fatal("Expected an error for an empty header")
+	}
+	if !header.DeliverFirstTime || !header.ManualThaw || !header.NoDelivery || header.HostAuth != "plain" || header.TLSCipher == "" {
+		t.Fatalf("Unexpected variables %+v", header)
+	}
+	if header.ACLVariables["c0"] != "a\nb" || header.ACLVariables["m_verified"] != "ok" || header.WarningCount != 2 {
+		t.Fatalf("Unexpected ACL variables %+v", header.ACLVariables)
+	}
+	if !reflect.DeepEqual(header.NonRecipients, []string{"one@example.com", "two@example.com", "three@example.com"}) {
+		t.Fatalf("Unexpected non-recipients %+v", header.NonRecipients)
+	}
+	expected := SpoolRecipient{Address: "four@example.com", ErrorsTo: "errors@example.com", ORcpt: "rfc822;Four@Example.com", DSNFlags: 10, Parent: -1}
+	if pending := header.Pending(); len(pending) != 1 || pending[0] != expected {
+		t.Fatalf("Unexpected pending recipients %+v", pending)
+	}
+
+	for _, truncated := range []string{"", "1rZeE0-00GmsY-CH-H\nexim 93\n", "1rZeE0-00GmsY-CH-H\nexim 93 93\n<>\n1707774748 0\nYN one@example.com\n"} {
+		if _, err := ParseSpoolHeader(strings.NewReader(truncated)); err == nil {
+			t.Fatalf("Expected an error parsing %q", truncated)
+		}
+	}
+}
+
+func TestQueueDomains(t *testing.T) {
+	tempPath := tempInputPath(t)
+	if err := copySampleInput(tempPath); err != nil {
+		t.Fatal("Unable to copy sample input:", err)
+	}
+	exporter := NewExporter("", "", "", "exim4", tempPath, "error", promlog.New(&promlog.Config{}))
+	queue, err := exporter.QueueSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := queue.Queue("")
+	if !reflect.DeepEqual(stats.senderDomains, map[string]float64{"<>": 2}) {
+		t.Fatalf("Unexpected sender domains %+v", stats.senderDomains)
+	}
+	if !reflect.DeepEqual(stats.recipientDomains, map[string]float64{"junk.bogus": 1, "mail.bogus": 1}) {
+		t.Fatalf("Unexpected recipient domains %+v", stats.recipientDomains)
+	}
+
+	counts := map[string]float64{"a.example": 1, "b.example": 5, "c.example": 2, "d.example": 2}
+	expected := []DomainCount{{"b.example", 5}, {"c.example", 2}, {"other", 3}}
+	if top := topDomains(counts, 2); !reflect.DeepEqual(top, expected) {
+		t.Fatalf("Unexpected top domains %+v", top)
+	}
+	expected = []DomainCount{{"b.example", 5}, {"c.example", 2}, {"d.example", 2}, {"a.example", 1}, {"other", 0}}
+	if top := topDomains(counts, 10); !reflect.DeepEqual(top, expected) {
+		t.Fatalf("Unexpected top domains %+v", top)
+	}
+}
+
+// TestLockHelper holds a lock on a file for TestSpoolIntegrity, since a process never conflicts with its own locks.
+func TestLockHelper(t *testing.T) {
+	filename := os.Getenv("EXIM_EXPORTER_TEST_LOCK")
+	if filename == "" {
+		return
+	}
+	fh, err := os.OpenFile(filename, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lock := syscall.Flock_t{Type: syscall.F_WRLCK, Whence: io.SeekStart}
+	if err := syscall.FcntlFlock(fh.Fd(), syscall.F_SETLK, &lock); err != nil {
+		t.Fatal(err)
+	}
+	fmt.Println("locked")
+	_, _ = io.ReadAll(os.Stdin)
+	os.Exit(0)
+}
+
+func TestSpoolIntegrity(t *testing.T) {
+	tempPath := tempInputPath(t)
+	if err := copySampleInput(tempPath); err != nil {
+		t.Fatal("Unable to copy sample input:", err)
+	}
+	data, err := os.ReadFile(filepath.Join(tempPath, "1rZeE0-00GmsY-CG-H"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		"1rZeE0-00GmsY-CH-H": data,
+		"1rZeE0-00GmsY-CI-D": nil,
+		"1rZeE0-00GmsY-CJ-H": []byte("not a header\n"),
+		"1rZeE0-00GmsY-CJ-D": nil,
+	}
+	for fileName, content := range files {
+		if err := os.WriteFile(filepath.Join(tempPath, fileName), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestLockHelper$")
+	cmd.Env = append(os.Environ(), "EXIM_EXPORTER_TEST_LOCK="+filepath.Join(tempPath, "1ra7OS-004XaW-CD-D"))
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = stdin.Close()
+		_ = cmd.Wait()
+	}()
+	if line, err := bufio.NewReader(stdout).ReadString('\n'); err != nil || line != "locked\n" {
+		t.Fatalf("Unable to lock data file: %q %v", line, err)
+	}
+
+	defer func(checkLocks bool) { *queueCheckLocks = checkLocks }(*queueCheckLocks)
+	*queueCheckLocks = true
+	exporter := NewExporter("", "", "", "exim4", tempPath, "error", promlog.New(&promlog.Config{}))
+	queue, err := exporter.QueueSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := queue.Queue("")
+	if stats.total != 4 || stats.orphanedHeaders != 1 || stats.orphanedData != 1 || stats.invalid != 1 || stats.locked != 1 {
+		t.Fatalf("Unexpected queue size %+v", stats)
+	}
+}
+
+func TestMsglog(t *testing.T) {
+	tempPath := tempInputPath(t)
+	if err := copySampleInput(tempPath); err != nil {
+		t.Fatal("Unable to copy sample input:", err)
+	}
+	msglogPath := filepath.Join(filepath.Dir(tempPath), "msglog")
+	if err := os.Mkdir(msglogPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// A message log as written by Exim, which marks deferrals with "defer (<errno>)" rather than the == of the main log
+	msglog := filepath.Join(msglogPath, "1ra7OS-004XaW-CD")
+	buf, err := os.ReadFile(filepath.Join("test", "msglog", "1ra7OS-004XaW-CD"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(msglog, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(readMsglog bool) { *queueReadMsglog = readMsglog }(*queueReadMsglog)
+	*queueReadMsglog = true
+	exporter := NewExporter("", "", "", "exim4", tempPath, "error", promlog.New(&promlog.Config{}))
+	queue, err := exporter.QueueSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := queue.Queue("")
+	if !reflect.DeepEqual(stats.deferred, map[string]float64{"remote_error": 1}) {
+		t.Fatalf("Unexpected deferrals %+v", stats.deferred)
+	}
+	if stats.attempts.count != 2 || stats.attempts.sum != 2 {
+		t.Fatalf("Unexpected delivery attempts %+v", stats.attempts)
+	}
+
+	// The message log is read again after another delivery attempt
+	fh, err := os.OpenFile(msglog, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fh.WriteString("2024-02-13 22:31:15 mailer@mail.bogus R=dnslookup T=remote_smtp defer (110): Connection timed out\n"); err != nil {
+		t.Fatal(err)
+	}
+	_ = fh.Close()
+	queue, err = exporter.QueueSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats = queue.Queue("")
+	if !reflect.DeepEqual(stats.deferred, map[string]float64{"timeout": 1}) || stats.attempts.sum != 3 {
+		t.Fatalf("Unexpected deferrals %+v %+v", stats.deferred, stats.attempts)
+	}
+}
+
+// retryValue builds a dbdata_retry struct as written by a 64-bit little endian build of Exim.
+func retryValue(firstFailed int64, text string) []byte {
+	value := make([]byte, 48)
+	binary.LittleEndian.PutUint32(value[8:], 111)
+	binary.LittleEndian.PutUint64(value[24:], uint64(firstFailed))
+	binary.LittleEndian.PutUint64(value[32:], uint64(firstFailed+600))
+	binary.LittleEndian.PutUint64(value[40:], uint64(firstFailed+1200))
+	return append(append(value, text...), 0)
+}
+
+type hintsRecord struct {
+	key   string
+	value []byte
+}
+
+// The records written to each format. Exim includes the terminating NUL in keys.
+var hintsRecords = []hintsRecord{
+	{"T:mx.mail.bogus:192.0.2.1\x00", retryValue(1707800000, "Connection refused")},
+	{"R:mail.bogus\x00", retryValue(1707890000, "host lookup did not complete")},
+	{"T:mx2.mail.bogus:192.0.2.2:1ra7OS-004XaW-CD\x00", retryValue(1707850000, strings.Repeat("x", 700))},
+}
+
+func buildGDBM(records []hintsRecord) []byte {
+	const dirOffset, bucketOffset, bucketElems, dataOffset = 64, 128, 4, 512
+	data := make([]byte, dataOffset)
+	binary.LittleEndian.PutUint32(data, 0x13579acf)
+	binary.LittleEndian.PutUint64(data[8:], dirOffset)
+	binary.LittleEndian.PutUint32(data[16:], 16)
+	binary.LittleEndian.PutUint32(data[28:], bucketElems)
+	// Both directory entries point to the same bucket
+	binary.LittleEndian.PutUint64(data[dirOffset:], bucketOffset)
+	binary.LittleEndian.PutUint64(data[dirOffset+8:], bucketOffset)
+	offset := dataOffset
+	for i := 0; i < bucketElems; i++ {
+		elem := data[bucketOffset+112+i*24 : bucketOffset+112+(i+1)*24]
+		if i >= len(records) {
+			binary.LittleEndian.PutUint32(elem, 0xffffffff)
+			continue
+		}
+		binary.LittleEndian.PutUint64(elem[8:], uint64(offset))
+		binary.LittleEndian.PutUint32(elem[16:], uint32(len(records[i].key)))
+		binary.LittleEndian.PutUint32(elem[20:], uint32(len(records[i].value)))
+		offset += len(records[i].key) + len(records[i].value)
+	}
+	for _, record := range records {
+		data = append(append(data, record.key...), record.value...)
+	}
+	return data
+}
+
+func buildTDB(records []hintsRecord) []byte {
+	const hashSize = 2
+	data := make([]byte, 256)
+	copy(data, "TDB file\n")
+	binary.LittleEndian.PutUint32(data[32:], 0x26011967+6)
+	binary.LittleEndian.PutUint32(data[36:], hashSize)
+	// Chain every record from the first bucket, with a deleted record in the middle
+	records = append([]hintsRecord{records[0], {"T:deleted\x00", retryValue(1, "")}}, records[1:]...)
+	next := 168 + 4
+	for i, record := range records {
+		header := make([]byte, 24)
+		binary.LittleEndian.PutUint32(header[8:], uint32(len(record.key)))
+		binary.LittleEndian.PutUint32(header[12:], uint32(len(record.value)))
+		binary.LittleEndian.PutUint32(header[20:], 0x26011999)
+		if i == 1 {
+			binary.LittleEndian.PutUint32(header[20:], 0xfee1dead)
+		}
+		binary.LittleEndian.PutUint32(data[next:], uint32(len(data)))
+		next = len(data)
+		data = append(append(append(data, header...), record.key...), record.value...)
+	}
+	return data
+}
+
+func buildBDBHash(records []hintsRecord) []byte {
+	const pageSize = 512
+	data := make([]byte, 2*pageSize)
+	binary.LittleEndian.PutUint32(data[12:], 0x061561)
+	binary.LittleEndian.PutUint32(data[16:], 9)
+	binary.LittleEndian.PutUint32(data[20:], pageSize)
+	data[25] = 8
+	page := data[pageSize:]
+	page[25] = 13
+	end := pageSize
+	entries := 0
+	addItem := func(item []byte) {
+		end -= len(item)
+		copy(page[end:], item)
+		binary.LittleEndian.PutUint16(page[26+entries*2:], uint16(end))
+		entries++
+	}
+	for _, record := range records {
+		addItem(append([]byte{1}, record.key...))
+		if len(record.value) < 256 {
+			addItem(append([]byte{1}, record.value...))
+			continue
+		}
+		// Store large values on a chain of overflow pages
+		item := make([]byte, 12)
+		item[0] = 3
+		binary.LittleEndian.PutUint32(item[4:], uint32(len(data)/pageSize))
+		binary.LittleEndian.PutUint32(item[8:], uint32(len(record.value)))
+		addItem(item)
+		for value := record.value; len(value) > 0; {
+			overflow := make([]byte, pageSize)
+			overflow[25] = 7
+			n := copy(overflow[26:], value)
+			binary.LittleEndian.PutUint16(overflow[22:], uint16(n))
+			if value = value[n:]; len(value) > 0 {
+				binary.LittleEndian.PutUint32(overflow[16:], uint32(len(data)/pageSize+1))
+			}
+			data = append(data, overflow...)
+			page = data[pageSize : 2*pageSize]
+		}
+	}
+	binary.LittleEndian.PutUint16(page[20:], uint16(entries))
+	return data
+}
+
+func TestRetryRecords(t *testing.T) {
+	timeNow = func() time.Time { return time.Unix(1707900000, 0) }
+	defer func() { timeNow = time.Now }()
+
+	// Databases written by the real libraries, by test/hintsdb/mkretrydb.c, with a longer text which takes an overflow
+	// page in BDB
+	realDB := func(name string) []byte {
+		data, err := os.ReadFile(filepath.Join("test", "hintsdb", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	for _, test := range []struct {
+		name     string
+		data     []byte
+		longText int
+	}{
+		{"gdbm", buildGDBM(hintsRecords), 700},
+		{"tdb", buildTDB(hintsRecords), 700},
+		{"bdb", buildBDBHash(hintsRecords), 700},
+		{"gdbm 1.23", realDB("retry-gdbm"), 1500},
+		{"bdb 5.3", realDB("retry-bdb.db"), 1500},
+	} {
+		data := test.data
+		t.Run(test.name, func(t *testing.T) {
+			tempPath := tempInputPath(t)
+			dbPath := filepath.Join(filepath.Dir(tempPath), "db")
+			if err := os.Mkdir(dbPath, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(dbPath, "retry"), data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			exporter := NewExporter("", "", "", "exim4", tempPath, "error", promlog.New(&promlog.Config{}))
+			records, err := exporter.RetryRecords()
+			if err != nil {
+				t.Fatal(err)
+			}
+			found := make(map[string]RetryRecord)
+			for _, record := range records {
+				found[record.Key] = record
+			}
+			if len(found) != len(hintsRecords) {
+				t.Fatalf("Expected %d records, got %+v", len(hintsRecords), found)
+			}
+			record := found["T:mx.mail.bogus:192.0.2.1"]
+			if record.Type() != "transport" || record.FirstFailed.Unix() != 1707800000 || record.NextTry.Unix() != 1707801200 ||
+				record.BasicErrno != 111 || record.Text != "Connection refused" {
+				t.Fatalf("Unexpected record %+v", record)
+			}
+			if record := found["T:mx2.mail.bogus:192.0.2.2:1ra7OS-004XaW-CD"]; record.Text != strings.Repeat("x", test.longText) {
+				t.Fatalf("Expected %d bytes of text, got %d", test.longText, len(record.Text))
+			}
+
+			expected := `
+# HELP exim_retry_oldest_seconds Time since the first failure of the oldest record in the retry hints database
+# TYPE exim_retry_oldest_seconds gauge
+exim_retry_oldest_seconds{type="routing"} 10000
+exim_retry_oldest_seconds{type="transport"} 100000
+# HELP exim_retry_records Number of records in the retry hints database broken down by type (routing, transport)
+# TYPE exim_retry_records gauge
+exim_retry_records{type="routing"} 1
+exim_retry_records{type="transport"} 2
+`
+			if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "exim_retry_records", "exim_retry_oldest_seconds"); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	if err := readHintsDB([]byte("not a database"), func(key, value []byte, order binary.ByteOrder) error { return nil }); err != errHintsFormat {
+		t.Fatalf("Expected %v, got %v", errHintsFormat, err)
+	}
+}
+
+func TestQueueAPI(t *testing.T) {
+	timeNow = func() time.Time { return time.Unix(1707900000, 0) }
+	defer func() { timeNow = time.Now }()
+	defer func(queueAPI bool) { *webQueueAPI = queueAPI }(*webQueueAPI)
+	*webQueueAPI = true
+	tempPath := tempInputPath(t)
+	if err := copySampleInput(tempPath); err != nil {
+		t.Fatal("Unable to copy sample input:", err)
+	}
+	exporter := NewExporter("", "", "", "exim4", tempPath, "error", promlog.New(&promlog.Config{}))
+
+	for _, test := range []struct {
+		query  string
+		status int
+		total  int
+		ids    []string
+	}{
+		{"", http.StatusOK, 2, []string{"1rZeE0-00GmsY-CG", "1ra7OS-004XaW-CD"}},
+		{"?limit=1&offset=1", http.StatusOK, 2, []string{"1ra7OS-004XaW-CD"}},
+		{"?offset=5", http.StatusOK, 2, []string{}},
+		{"?recipient=@junk\\.bogus$", http.StatusOK, 1, []string{"1rZeE0-00GmsY-CG"}},
+		{"?sender=.", http.StatusOK, 0, []string{}},
+		{"?frozen=false", http.StatusOK, 1, []string{"1ra7OS-004XaW-CD"}},
+		{"?min_age=24h", http.StatusOK, 1, []string{"1rZeE0-00GmsY-CG"}},
+		{"?max_age=24h&queue=", http.StatusOK, 1, []string{"1ra7OS-004XaW-CD"}},
+		{"?queue=bulk", http.StatusOK, 0, []string{}},
+		{"?recipient=(", http.StatusBadRequest, 0, nil},
+		{"?limit=0", http.StatusBadRequest, 0, nil},
+		{"?min_age=1", http.StatusBadRequest, 0, nil},
+	} {
+		recorder := httptest.NewRecorder()
+		exporter.ServeQueueAPI(recorder, httptest.NewRequest("GET", "/api/v1/queue"+test.query, nil))
+		if recorder.Code != test.status {
+			t.Fatalf("%s: expected status %d, got %d: %s", test.query, test.status, recorder.Code, recorder.Body)
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		var listing QueueListing
+		if err := json.Unmarshal(recorder.Body.Bytes(), &listing); err != nil {
+			t.Fatal(err)
+		}
+		ids := make([]string, 0)
+		for _, message := range listing.Messages {
+			ids = append(ids, message.ID)
+		}
+		if listing.Total != test.total || !reflect.DeepEqual(ids, test.ids) {
+			t.Fatalf("%s: expected %d messages %v, got %d %v", test.query, test.total, test.ids, listing.Total, ids)
+		}
+	}
+
+	listing := exporter.ListQueue(QueueFilter{Limit: 1})
+	expected := QueuedMessage{
+		ID:         "1rZeE0-00GmsY-CG",
+		Sender:     "",
+		Recipients: []QueuedRecipient{{"postmaster@junk.bogus", false}},
+		Frozen:     true,
+	}
+	message := listing.Messages[0]
+	if message.ID != expected.ID || message.Sender != expected.Sender || message.Frozen != expected.Frozen ||
+		!reflect.DeepEqual(message.Recipients, expected.Recipients) || message.Size == 0 || int(message.AgeSeconds) != 125251 {
+		t.Fatalf("Unexpected message %+v", message)
+	}
+}
+
+func TestParseQueueListing(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		output string
+		stats  QueueStats
+		err    string
+	}{
+		{
+			name: "bp",
+			output: `35h  950 1rZeE0-00GmsY-CG <> *** frozen ***
+          postmaster@junk.bogus
+
+ 4h  2.9K 1ra7OS-004XaW-CD <sender@Home.bogus>
+        D delivered@mail.bogus
+       +D generated@mail.bogus
+          mailer@mail.bogus
+          other@mail.bogus
+
+45m   12M 1rb9XY-000ABC-DE <sender@home.bogus> (root)
+          mailer@Mail.Bogus
+`,
+			stats: QueueStats{total: 3, frozen: 1, bytes: 950 + 2.9*1024 + 12*1024*1024, recipients: 6, pending: 4},
+		},
+		{name: "bpc", output: "42\n", stats: QueueStats{total: 42}},
+		{name: "empty", output: "", stats: QueueStats{}},
+		{name: "garbage", output: "exim: permission denied\n", err: `line 1: unexpected "exim: permission denied"`},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			stats, err := ParseQueueListing(strings.NewReader(test.output))
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("Expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats.total != test.stats.total || stats.frozen != test.stats.frozen || stats.bytes != test.stats.bytes ||
+				stats.recipients != test.stats.recipients || stats.pending != test.stats.pending {
+				t.Fatalf("Expected %+v, got %+v", test.stats, stats)
+			}
+		})
+	}
+
+	stats, _ := ParseQueueListing(strings.NewReader("35h  950 1rZeE0-00GmsY-CG <> *** frozen ***\n          postmaster@junk.bogus\n\n 4h  2.9K 1ra7OS-004XaW-CD <sender@home.bogus>\n          mailer@mail.bogus\n          other@Mail.Bogus\n"))
+	if stats.ages.max != 35*3600 || stats.ages.sum != 39*3600 {
+		t.Fatalf("Unexpected ages %+v", stats.ages)
+	}
+	// Messages with several recipients at a domain are counted once for it
+	if !reflect.DeepEqual(stats.senderDomains, map[string]float64{"<>": 1, "home.bogus": 1}) ||
+		!reflect.DeepEqual(stats.recipientDomains, map[string]float64{"junk.bogus": 1, "mail.bogus": 1}) {
+		t.Fatalf("Unexpected domains %+v %+v", stats.senderDomains, stats.recipientDomains)
+	}
+}
+
+func TestQueueCommand(t *testing.T) {
+	tempPath := tempInputPath(t)
+	listing := filepath.Join(tempPath, "listing")
+	if err := os.WriteFile(listing, []byte("35h  950 1rZeE0-00GmsY-CG <> *** frozen ***\n          postmaster@junk.bogus\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer func(command string, timeout time.Duration) { *queueCommand, *frozenTimeout = command, timeout }(*queueCommand, *frozenTimeout)
+	exporter := NewExporter("", "", "", "exim4", tempPath, "error", promlog.New(&promlog.Config{}))
+
+	*queueCommand = "cat " + listing
+	queue, err := exporter.QueueSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := queue.Queue(""); stats.total != 1 || stats.frozen != 1 {
+		t.Fatalf("Unexpected queue size %+v", stats)
+	}
+
+	*queueCommand = "cat " + filepath.Join(tempPath, "missing")
+	if _, err := exporter.QueueSize(); err == nil || !strings.Contains(err.Error(), "No such file or directory") {
+		t.Fatalf("Expected the command's error, got %v", err)
+	}
+
+	*queueCommand = "sleep 5"
+	*frozenTimeout = 50 * time.Millisecond
+	timeouts := testutil.ToFloat64(eximQueueStateTimeoutErrors)
+	start := time.Now()
+	if _, err := exporter.QueueSize(); err == nil || time.Since(start) > 2*time.Second {
+		t.Fatalf("Expected the command to time out, got %v after %s", err, time.Since(start))
+	}
+	if testutil.ToFloat64(eximQueueStateTimeoutErrors) != timeouts+1 {
+		t.Fatal("Expected the timeout to be counted")
+	}
+
+	// Processes started by a wrapper are killed as well
+	wrapper := filepath.Join(tempPath, "wrapper")
+	if err := os.WriteFile(wrapper, []byte("#!/bin/sh\nsleep 5\necho done\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	*queueCommand = wrapper
+	start = time.Now()
+	if _, err := exporter.QueueSize(); err == nil || time.Since(start) > 2*time.Second {
+		t.Fatalf("Expected the wrapper to time out, got %v after %s", err, time.Since(start))
+	}
+}
+
+func TestParseEximArgs(t *testing.T) {
+	for _, test := range []struct {
+		args   []string
+		leader bool
+		state  string
+		queue  string
+	}{
+		{nil, false, "other", ""},
+		{[]string{"-bd", "-q30m"}, true, "daemon", ""},
+		{[]string{"-bdf", "-q30m"}, true, "daemon", ""},
+		{[]string{"-ps", "-bd", "-q15m", "-oP", "/var/spool/exim/exim-daemon.pid"}, true, "daemon", ""},
+		// A child of the daemon handling an SMTP connection
+		{[]string{"-ps", "-bd", "-q15m", "-oP", "/var/spool/exim/exim-daemon.pid"}, false, "handling", ""},
+		{[]string{"-bd"}, false, "handling", ""},
+		{[]string{"-bd", "-q30m"}, false, "handling", ""},
+		{[]string{"-bs"}, false, "handling", ""},
+		// A queue run outranks handling, should both be given
+		{[]string{"-bs", "-q"}, false, "running", ""},
+		{[]string{"-q30m"}, true, "daemon", ""},
+		{[]string{"-q30m"}, false, "running", ""},
+		{[]string{"-q1h30m"}, true, "daemon", ""},
+		{[]string{"-q"}, false, "running", ""},
+		{[]string{"-qq"}, false, "running", ""},
+		{[]string{"-qqff"}, false, "running", ""},
+		{[]string{"-qG"}, false, "running", ""},
+		{[]string{"-qGbulk"}, false, "running", "bulk"},
+		{[]string{"-qqGbulk"}, false, "running", "bulk"},
+		{[]string{"-qGbulk/5m"}, false, "running", "bulk"},
+		{[]string{"-qGbulk/5m"}, true, "daemon", ""},
+		{[]string{"-R", "mail.bogus"}, false, "running", ""},
+		{[]string{"-Rff", "mail.bogus"}, false, "running", ""},
+		{[]string{"-qS", "sender@mail.bogus"}, false, "running", ""},
+		{[]string{"-qxyz"}, false, "other", ""},
+		{[]string{"-Mc", "1jofsL-0006tb-8D"}, false, "delivering", ""},
+		{[]string{"-M", "1jofsL-0006tb-8D"}, false, "delivering", ""},
+		{[]string{"-MCK", "-MC", "remote_smtp", "mx.mail.bogus", "192.0.2.1", "2", "1jofsL-0006tb-8D"}, false, "delivering", ""},
+		// The delivery of the default queue, started by a runner of a named queue
+		{[]string{"-qGbulk", "-Mc", "1jofsL-0006tb-8D"}, false, "delivering", ""},
+		// A delivery continued over an existing connection by a queue runner
+		{[]string{"-MC", "remote_smtp", "mx.mail.bogus", "192.0.2.1", "2", "-qq", "1jofsL-0006tb-8D"}, false, "delivering", ""},
+		{[]string{"-qq", "-MCK", "-MC", "remote_smtp", "mx.mail.bogus", "192.0.2.1", "2", "1jofsL-0006tb-8D"}, false, "delivering", ""},
+		{[]string{"-t"}, false, "submitting", ""},
+		{[]string{"-bS"}, false, "submitting", ""},
+		{[]string{"-odf", "-i", "user@mail.bogus"}, false, "submitting", ""},
+		{[]string{"-i", "-f", "sender@mail.bogus", "--", "user@mail.bogus"}, false, "submitting", ""},
+		{[]string{"-f", "sender@mail.bogus"}, false, "other", ""},
+		{[]string{"-bp"}, false, "other", ""},
+		{[]string{"-bpc"}, false, "other", ""},
+		{[]string{"-Mrm", "1jofsL-0006tb-8D", "1jofsL-0006tb-8E"}, false, "other", ""},
+	} {
+		state, queue := parseEximArgs(test.args, test.leader)
+		if state != test.state || queue != test.queue {
+			t.Errorf("%v (leader %t): expected %q %q, got %q %q", test.args, test.leader, test.state, test.queue, state, queue)
+		}
+	}
+
+	// The README lists the states in order of priority
+	readme, err := os.ReadFile("README.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, table, _ := strings.Cut(string(readme), "| Prom Label | Exim State")
+	var states []string
+	for _, line := range strings.Split(table, "\n")[2:] {
+		if !strings.HasPrefix(line, "|") {
+			break
+		}
+		states = append(states, strings.TrimSpace(strings.Split(line, "|")[1]))
+	}
+	if len(states) != len(processStatePriority) {
+		t.Fatalf("README lists states %v", states)
+	}
+	for i, state := range states {
+		if processStatePriority[state] != len(states)-1-i {
+			t.Errorf("README lists %q in position %d, but its priority is %d", state, i, processStatePriority[state])
+		}
+	}
+}
+
+// writeProc adds a process to a fake procfs.
+func writeProc(t *testing.T, procfs string, pid, pgrp int, cmdline []string, fds int) {
+	dir := filepath.Join(procfs, strconv.Itoa(pid))
+	if err := os.MkdirAll(filepath.Join(dir, "fd"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < fds; i++ {
+		if err := os.Symlink("/dev/null", filepath.Join(dir, "fd", strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// utime 250 and stime 50 ticks, started 1000 ticks after boot, with a command name containing ") "
+	stat := fmt.Sprintf("%d (exim4) S) S 1 %d %d 0 -1 4194560 100 0 0 0 250 50 0 0 20 0 1 0 1000 10000000 512 18446744073709551615 0 0 0 0 0 0 0 0 0 0 0 0 17 0 0 0 0 0 0\n", pid, pgrp, pgrp)
+	files := map[string]string{
+		"cmdline": strings.Join(cmdline, "\x00") + "\x00",
+		"stat":    stat,
+		"statm":   "2500 512 256 100 0 300 0\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReadProcesses(t *testing.T) {
+	procfs := t.TempDir()
+	// Boot time, from /proc/stat or /proc/uptime in containers
+	boot := time.Now().Add(-time.Hour).Unix()
+	if err := os.WriteFile(filepath.Join(procfs, "stat"), []byte(fmt.Sprintf("cpu  1 2 3 4\nbtime %d\n", boot)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(procfs, "uptime"), []byte(fmt.Sprintf("%d.00 0.00\n", time.Now().Unix()-boot)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// PIDs which don't exist outside the fake procfs
+	writeProc(t, procfs, 4000001, 4000001, []string{"/usr/sbin/exim4", "-bd", "-q30m"}, 3)
+	writeProc(t, procfs, 4000002, 4000001, []string{"/usr/sbin/exim4", "-Mc", "1jofsL-0006tb-8D"}, 5)
+	writeProc(t, procfs, 4000003, 4000003, []string{"/bin/bash"}, 1)
+	// Kernel threads have an empty command line, and processes may exit while being read
+	writeProc(t, procfs, 4000004, 0, []string{}, 0)
+	if err := os.Mkdir(filepath.Join(procfs, "4000005"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	processes, err := readProcesses(procfs, "exim4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	byCommand := make(map[string]*Process)
+	for _, p := range processes {
+		byCommand[strings.Join(p.cmdline, " ")] = p
+	}
+	if len(processes) != 4 {
+		t.Fatalf("Expected 4 processes, got %+v", byCommand)
+	}
+	daemon, delivery, shell := byCommand["/usr/sbin/exim4 -bd -q30m"], byCommand["/usr/sbin/exim4 -Mc 1jofsL-0006tb-8D"], byCommand["/bin/bash"]
+	if daemon == nil || delivery == nil || shell == nil {
+		t.Fatalf("Missing processes %+v", byCommand)
+	}
+	if !daemon.leader || delivery.leader || !shell.leader {
+		t.Fatalf("Unexpected process group leaders %+v %+v %+v", daemon, delivery, shell)
+	}
+	pageSize := float64(os.Getpagesize())
+	if delivery.fds != 5 || delivery.rss != 512*pageSize || delivery.cpuSeconds != 3 {
+		t.Fatalf("Unexpected resource usage %+v", delivery)
+	}
+	if started := time.Unix(boot+10, 0); delivery.started.Sub(started).Abs() > 2*time.Second {
+		t.Fatalf("Expected start time %s, got %s", started, delivery.started)
+	}
+	// Usage is only read for exim
+	if shell.fds != 0 || !shell.started.IsZero() {
+		t.Fatalf("Unexpected resource usage %+v", shell)
+	}
+
+	exporter := NewExporter("", "", "", "exim4", "", "error", promlog.New(&promlog.Config{}))
+	defer func(procfs, exec string) { *procfsPath, *eximExec = procfs, exec }(*procfsPath, *eximExec)
+	*procfsPath, *eximExec = procfs, "exim4"
+	states, _ := exporter.ProcessStates()
+	if states["daemon"] == nil || states["daemon"].count != 1 || states["delivering"] == nil || states["delivering"].fds != 5 {
+		t.Fatalf("Unexpected process states %+v", states)
+	}
+}
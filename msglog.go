@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var attemptBuckets = []float64{0, 1, 2, 3, 5, 10, 20, 50, 100}
+
+// A deferred address in a message log, as written by deliver.c: the timestamp, the address (followed by its parents
+// with log_selector = +all_parents), the sender, queue, router and transport, then the errno and the reason. Unlike the
+// main log, there is no == marker.
+var msglogDeferRegexp = regexp.MustCompile(`^(\d{4}-\d\d-\d\d \d\d:\d\d:\d\d(?:\.\d{3})?(?: [-+]\d{4})?) \S+(?: <[^>]*>)*(?: [A-Z]=\S+| routing)* defer \((-?\d+)\)(.*)$`)
+
+// deferReasons categorises deferrals by the text logged for them. The first matching category is used.
+var deferReasons = []struct {
+	reason  string
+	matches []string
+}{
+	{"retry_time", []string{"retry time not reached"}},
+	{"connection_refused", []string{"Connection refused"}},
+	{"timeout", []string{"timed out", "timeout"}},
+	{"dns", []string{"host lookup did not complete", "DNS"}},
+	{"tls", []string{"TLS"}},
+	{"quota", []string{"quota", "Quota", "mailbox is full", "Mailbox is full"}},
+	{"remote_error", []string{"SMTP error from remote mail server"}},
+	{"connection", []string{"Connection reset", "Network is unreachable", "No route to host", "Remote host closed connection"}},
+}
+
+func deferReason(text string) string {
+	for _, category := range deferReasons {
+		for _, match := range category.matches {
+			if strings.Contains(text, match) {
+				return category.reason
+			}
+		}
+	}
+	return "other"
+}
+
+// msglogPath returns the path of the message log kept by Exim for a queued message, which mirrors the layout of the
+// input directory: spool/msglog/<id> or, with split_spool_directory, spool/msglog/<hash>/<id>.
+func (e *Exporter) msglogPath(message *SpoolMessage) string {
+	input := e.queueInputPath(message.queue)
+	rel, err := filepath.Rel(input, message.path)
+	if err != nil {
+		rel = filepath.Base(message.path)
+	}
+	return filepath.Join(filepath.Dir(input), "msglog", strings.TrimSuffix(rel, "-H"))
+}
+
+// readMsglog reads the delivery history of a message, if the message log has changed since it was last read.
+// Each delivery attempt logs a defer line for each deferred address, so the number of attempts is the number of
+// distinct times those lines were logged at. Exim only logs "retry time not reached" on the first attempt, so queue runs
+// which skip the message aren't counted.
+func (e *Exporter) readMsglog(message *SpoolMessage) {
+	filename := e.msglogPath(message)
+	info, err := os.Lstat(filename)
+	if err != nil {
+		// Not created until the first delivery attempt
+		message.attempts, message.deferReason = 0, ""
+		return
+	}
+	if info.Size() == message.msglogSize && info.ModTime().Equal(message.msglogMtime) {
+		return
+	}
+	fh, err := os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer func() { _ = fh.Close() }()
+	message.msglogSize, message.msglogMtime = info.Size(), info.ModTime()
+
+	attempts := make(map[string]bool)
+	lastDeferral := ""
+	scanner := bufio.NewScanner(fh)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		match := msglogDeferRegexp.FindStringSubmatch(scanner.Text())
+		if match == nil {
+			continue
+		}
+		attempts[match[1]] = true
+		lastDeferral = match[3]
+	}
+	message.attempts = len(attempts)
+	message.deferReason = ""
+	if lastDeferral != "" {
+		message.deferReason = deferReason(lastDeferral)
+	}
+}
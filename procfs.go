@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/shirou/gopsutil/v3/common"
+	"github.com/shirou/gopsutil/v3/process"
+)
+
+// processGroup reads the process group of a process from <procfs>/<pid>/stat, rather than asking the kernel, so it
+// works for processes in another PID namespace.
+func processGroup(procfs string, pid int32) (int32, error) {
+	stat, err := os.ReadFile(filepath.Join(procfs, strconv.Itoa(int(pid)), "stat"))
+	if err != nil {
+		return 0, err
+	}
+	// The command name may contain spaces and parentheses, so the fields are counted from the last ')':
+	// pid (comm) state ppid pgrp ...
+	end := bytes.LastIndexByte(stat, ')')
+	if end < 0 {
+		return 0, fmt.Errorf("invalid stat for pid %d", pid)
+	}
+	fields := bytes.Fields(stat[end+1:])
+	if len(fields) < 3 {
+		return 0, fmt.Errorf("invalid stat for pid %d", pid)
+	}
+	pgrp, err := strconv.ParseInt(string(fields[2]), 10, 32)
+	return int32(pgrp), err
+}
+
+// readProcesses lists the processes in a procfs, which can be the host's /proc mounted into a container. Resource
+// usage is only read for processes running the exim executable.
+func readProcesses(procfs, eximExec string) ([]*Process, error) {
+	ctx := context.WithValue(context.Background(), common.EnvKey, common.EnvMap{common.HostProcEnvKey: procfs})
+	pids, err := process.PidsWithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*Process, 0)
+	for _, pid := range pids {
+		// process.NewProcess checks the pid exists by signalling it, which doesn't work in another PID namespace
+		p := &process.Process{Pid: pid}
+		cmdline, err := p.CmdlineSliceWithContext(ctx)
+		if err != nil {
+			continue
+		}
+		pgid, err := processGroup(procfs, pid)
+		if err != nil {
+			continue
+		}
+		proc := &Process{cmdline: cmdline, leader: pid == pgid}
+		if len(cmdline) > 0 && path.Base(cmdline[0]) == eximExec {
+			// Processes may exit at any time, so usage which can't be read is left out
+			if created, err := p.CreateTimeWithContext(ctx); err == nil {
+				proc.started = time.UnixMilli(created)
+			}
+			if times, err := p.TimesWithContext(ctx); err == nil {
+				proc.cpuSeconds = times.User + times.System
+			}
+			if memory, err := p.MemoryInfoWithContext(ctx); err == nil {
+				proc.rss = float64(memory.RSS)
+			}
+			if fds, err := p.NumFDsWithContext(ctx); err == nil {
+				proc.fds = float64(fds)
+			}
+		}
+		result = append(result, proc)
+	}
+	return result, nil
+}
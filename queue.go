@@ -0,0 +1,727 @@
+package main
+
+import (
+	"io"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// QueueSize holds the statistics of each queue, keyed by queue name. The default queue is named "".
+type QueueSize struct {
+	queues   map[string]*QueueStats
+	timedOut bool
+}
+
+type QueueStats struct {
+	total  float64
+	frozen float64
+	// Header files which couldn't be parsed, or have no data file, data files with no header file, and messages with
+	// their data file locked by a delivery process
+	invalid         float64
+	orphanedHeaders float64
+	orphanedData    float64
+	locked          float64
+	// The number of entries in each of the queue's directories
+	directories map[string]float64
+	// The size of the header and data files
+	bytes      float64
+	recipients float64
+	pending    float64
+	ages       QueueHistogram
+	// The number of delivery attempts of each message, and the number of messages by the reason for their last
+	// deferral, when message logs are read
+	attempts QueueHistogram
+	deferred map[string]float64
+	// The number of messages with each of queueFlags set
+	flags []float64
+	// The number of messages from each sender domain, and with pending recipients at each recipient domain
+	senderDomains    map[string]float64
+	recipientDomains map[string]float64
+}
+
+func newQueueStats() *QueueStats {
+	return &QueueStats{
+		ages:             newQueueHistogram(queueAgeBuckets),
+		attempts:         newQueueHistogram(attemptBuckets),
+		deferred:         make(map[string]float64),
+		flags:            make([]float64, len(queueFlags)),
+		senderDomains:    make(map[string]float64),
+		recipientDomains: make(map[string]float64),
+	}
+}
+
+// DomainCount is the number of messages for a domain.
+type DomainCount struct {
+	Domain string
+	Count  float64
+}
+
+// topDomains returns the k domains with the most messages, followed by the total for the rest as "other".
+func topDomains(counts map[string]float64, k int) []DomainCount {
+	sorted := make([]DomainCount, 0, len(counts))
+	for domain, count := range counts {
+		sorted = append(sorted, DomainCount{domain, count})
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Count != sorted[j].Count {
+			return sorted[i].Count > sorted[j].Count
+		}
+		return sorted[i].Domain < sorted[j].Domain
+	})
+	other := DomainCount{Domain: "other"}
+	for len(sorted) > k {
+		other.Count += sorted[len(sorted)-1].Count
+		sorted = sorted[:len(sorted)-1]
+	}
+	return append(sorted, other)
+}
+
+// addressDomain returns the lower cased domain of an address, or <> for the null sender of bounces. Unqualified
+// addresses have no domain.
+func addressDomain(address string) string {
+	if address == "" {
+		return "<>"
+	}
+	at := strings.LastIndexByte(address, '@')
+	if at < 0 {
+		return ""
+	}
+	return strings.ToLower(address[at+1:])
+}
+
+// queueFlags are the spool header variables counted by exim_queue_flags.
+var queueFlags = []struct {
+	label string
+	isSet func(*SpoolHeader) bool
+}{
+	// Bounces and other messages generated by Exim itself
+	{"local_error", func(h *SpoolHeader) bool { return h.LocalError }},
+	{"manual_thaw", func(h *SpoolHeader) bool { return h.ManualThaw }},
+	// No delivery has been attempted yet
+	{"deliver_firsttime", func(h *SpoolHeader) bool { return h.DeliverFirstTime }},
+	{"no_delivery", func(h *SpoolHeader) bool { return h.NoDelivery }},
+	{"authenticated", func(h *SpoolHeader) bool { return h.HostAuth != "" }},
+	{"tls", func(h *SpoolHeader) bool { return h.TLSCipher != "" }},
+}
+
+// Queue returns the statistics of the named queue, which are zero if the queue wasn't found.
+func (q QueueSize) Queue(name string) QueueStats {
+	if stats, ok := q.queues[name]; ok {
+		return *stats
+	}
+	return QueueStats{}
+}
+
+var queueAgeBuckets = []float64{60, 300, 900, 1800, 3600, 7200, 14400, 28800, 86400, 172800, 604800}
+
+// QueueHistogram counts queued messages or processes by a value, such as the time since they were received.
+type QueueHistogram struct {
+	bounds []float64
+	counts []uint64
+	count  uint64
+	sum    float64
+	max    float64
+}
+
+func newQueueHistogram(bounds []float64) QueueHistogram {
+	return QueueHistogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+func (h *QueueHistogram) Observe(value float64) {
+	for i, bound := range h.bounds {
+		if value <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += value
+	if value > h.max {
+		h.max = value
+	}
+}
+
+func (h *QueueHistogram) Buckets() map[float64]uint64 {
+	buckets := make(map[float64]uint64, len(h.bounds))
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i]
+		buckets[bound] = cumulative
+	}
+	return buckets
+}
+
+// SpoolMessage holds what the queue metrics need from a message's header file, along with the file's identity,
+// so the header only has to be read again if the file was replaced or modified.
+type SpoolMessage struct {
+	queue    string
+	path     string
+	inode    uint64
+	mtime    time.Time
+	size     int64
+	parsed   bool
+	frozen   bool
+	flags    uint32
+	received time.Time
+	// The data file is only written when the message is received, so its size is read along with the header
+	dataSize   int64
+	recipients int
+	pending    int
+	// The sender and recipients, only kept for the queue API
+	sender    string
+	addresses []QueuedRecipient
+	// The domains of the sender, and of the pending recipients without duplicates
+	senderDomain     string
+	recipientDomains []string
+	// The size and modification time of the message log when it was last read, and the delivery history read from it
+	msglogSize  int64
+	msglogMtime time.Time
+	attempts    int
+	deferReason string
+	// The header couldn't be parsed
+	invalid bool
+	// No data file was found the last time the spool was read
+	orphaned bool
+	seen     bool
+}
+
+// SpoolCache remembers the queued messages between scrapes, keyed by message ID.
+type SpoolCache struct {
+	mu       sync.Mutex
+	messages map[string]*SpoolMessage
+	// The named queues found when the spool was last read
+	queues []string
+	// The data files without a header, mapped to their queue, and the number of entries in each of the queue's
+	// directories, keyed by path relative to its input directory. When the spool is watched, both are kept up to date
+	// as files are created and removed.
+	orphanedData map[string]string
+	dirSizes     map[string]map[string]float64
+	// Set when the spool is watched for changes, so it doesn't need to be read on each scrape.
+	watched bool
+}
+
+func NewSpoolCache() *SpoolCache {
+	return &SpoolCache{messages: make(map[string]*SpoolMessage)}
+}
+
+// message ID in exim >= 4.97 are 25 chars
+// message ID in exim < 4.97 are only 18 chars
+// Each message has a header and data file, so only count one of them
+func headerMessageID(fileName string) (string, bool) {
+	return spoolMessageID(fileName, "-H")
+}
+
+func spoolMessageID(fileName, suffix string) (string, bool) {
+	if !(len(fileName) == 25 || len(fileName) == 18) || !strings.HasSuffix(fileName, suffix) {
+		return "", false
+	}
+	return strings.TrimSuffix(fileName, suffix), true
+}
+
+// Update adds the header file to the cache. If it replaces a cached file, or the file was modified, the header will be
+// read again. The caller must hold the lock.
+func (c *SpoolCache) Update(id, queue, filename string, info os.FileInfo) *SpoolMessage {
+	var inode uint64
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		inode = stat.Ino
+	}
+	message, ok := c.messages[id]
+	if !ok || message.path != filename || message.inode != inode || !message.mtime.Equal(info.ModTime()) || message.size != info.Size() {
+		message = &SpoolMessage{queue: queue, path: filename, inode: inode, mtime: info.ModTime(), size: info.Size()}
+		c.messages[id] = message
+	}
+	return message
+}
+
+// spoolEntry is a header file found while reading a spool directory.
+type spoolEntry struct {
+	id       string
+	queue    string
+	filename string
+	info     os.FileInfo
+	hasData  bool
+}
+
+// Named queues (queue_name) are stored in spool/<name>/input, next to the default queue's input directory.
+func (e *Exporter) queueInputPath(queue string) string {
+	if queue == "" {
+		return e.inputPath
+	}
+	return filepath.Join(filepath.Dir(e.inputPath), queue, "input")
+}
+
+// inputQueue returns the queue the input directory belongs to.
+func (e *Exporter) inputQueue(dirname string) (string, bool) {
+	dirname = filepath.Clean(dirname)
+	if dirname == filepath.Clean(e.inputPath) {
+		return "", true
+	}
+	if filepath.Base(dirname) == "input" && filepath.Dir(filepath.Dir(dirname)) == filepath.Dir(filepath.Clean(e.inputPath)) {
+		return filepath.Base(filepath.Dir(dirname)), true
+	}
+	return "", false
+}
+
+// NamedQueues returns the names of the queues found in the spool directory.
+func (e *Exporter) NamedQueues() []string {
+	root := filepath.Dir(filepath.Clean(e.inputPath))
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil
+	}
+	queues := make([]string, 0)
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		input := filepath.Join(root, entry.Name(), "input")
+		if input == filepath.Clean(e.inputPath) {
+			continue
+		}
+		if info, err := os.Stat(input); err == nil && info.IsDir() {
+			queues = append(queues, entry.Name())
+		}
+	}
+	return queues
+}
+
+// queueDirs returns the input directory of the queue, followed by its hash directories.
+func (e *Exporter) queueDirs(queue string) []string {
+	input := e.queueInputPath(queue)
+	dirs := make([]string, 0, len(BASE62)+1)
+	dirs = append(dirs, input)
+	for h := 0; h < len(BASE62); h++ {
+		dirs = append(dirs, filepath.Join(input, string(BASE62[h])))
+	}
+	return dirs
+}
+
+// spoolDir is what was found while reading a spool directory.
+type spoolDir struct {
+	messages []spoolEntry
+	// Data files without a header file
+	orphanedData []string
+	// Every entry in the directory, including temporary files and hash directories
+	size int
+}
+
+// readSpoolDir returns the header files in dirname, and the data files without a header. It doesn't touch the cache,
+// so directories can be read concurrently.
+func readSpoolDir(queue, dirname string) (spoolDir, error) {
+	dir, err := os.Open(dirname)
+	if err != nil {
+		return spoolDir{}, err
+	}
+	messages, err := dir.Readdirnames(-1)
+	_ = dir.Close()
+	if err != nil {
+		return spoolDir{}, err
+	}
+	data := make(map[string]bool, len(messages)/2)
+	headers := make(map[string]bool, len(messages)/2)
+	for _, fileName := range messages {
+		if id, ok := spoolMessageID(fileName, "-D"); ok {
+			data[id] = true
+		} else if id, ok := headerMessageID(fileName); ok {
+			headers[id] = true
+		}
+	}
+	orphanedData := make([]string, 0)
+	for id := range data {
+		if !headers[id] {
+			orphanedData = append(orphanedData, path.Join(dirname, id+"-D"))
+		}
+	}
+	entries := make([]spoolEntry, 0, len(headers))
+	for _, fileName := range messages {
+		id, ok := headerMessageID(fileName)
+		if !ok {
+			continue
+		}
+		filename := path.Join(dirname, fileName)
+		info, err := os.Lstat(filename)
+		if err != nil {
+			// The message was delivered since the directory was read
+			continue
+		}
+		entries = append(entries, spoolEntry{id, queue, filename, info, data[id]})
+	}
+	return spoolDir{entries, orphanedData, len(messages)}, nil
+}
+
+// addSpoolEntries adds the header files to the spool cache, marking them as seen. The caller must hold the lock.
+func (e *Exporter) addSpoolEntries(entries []spoolEntry) {
+	for _, entry := range entries {
+		message := e.spool.Update(entry.id, entry.queue, entry.filename, entry.info)
+		message.seen = true
+		message.orphaned = !entry.hasData
+	}
+}
+
+// addSpoolDir adds what was found in a spool directory to the cache. The caller must hold the lock.
+func (e *Exporter) addSpoolDir(queue, dirname string, dir spoolDir) {
+	for _, filename := range dir.orphanedData {
+		e.spool.orphanedData[filename] = queue
+	}
+	if e.spool.dirSizes[queue] == nil {
+		e.spool.dirSizes[queue] = make(map[string]float64)
+	}
+	if rel, err := filepath.Rel(e.queueInputPath(queue), dirname); err == nil {
+		e.spool.dirSizes[queue][rel] = float64(dir.size)
+	}
+	e.addSpoolEntries(dir.messages)
+}
+
+// ScanSpoolDir adds the messages in dirname to the spool cache, marking them as seen. The caller must hold the lock.
+func (e *Exporter) ScanSpoolDir(queue, dirname string) error {
+	dir, err := readSpoolDir(queue, dirname)
+	if err != nil {
+		return err
+	}
+	e.addSpoolDir(queue, dirname, dir)
+	return nil
+}
+
+// SyncSpool brings the spool cache up to date by reading the input directory and all hash directories of every queue,
+// up to --queue.concurrency at a time. If the default queue's input directory can't be read, the cache is left as it
+// was. The caller must hold the lock.
+func (e *Exporter) SyncSpool() error {
+	e.spool.queues = e.NamedQueues()
+	var dirs, queues []string
+	for _, queue := range append([]string{""}, e.spool.queues...) {
+		for _, dirname := range e.queueDirs(queue) {
+			dirs = append(dirs, dirname)
+			queues = append(queues, queue)
+		}
+	}
+	contents := make([]spoolDir, len(dirs))
+	errs := make([]error, len(dirs))
+	parallel(len(dirs), func(i int) {
+		contents[i], errs[i] = readSpoolDir(queues[i], dirs[i])
+	})
+	if errs[0] != nil {
+		return errs[0]
+	}
+	e.spool.orphanedData = make(map[string]string)
+	e.spool.dirSizes = make(map[string]map[string]float64)
+	for i, dirname := range dirs {
+		// Hash directories are only created once a message is queued in them, and named queues may be removed
+		if errs[i] != nil {
+			if !os.IsNotExist(errs[i]) {
+				_ = level.Warn(e.logger).Log("msg", "Unable to read spool directory", "path", dirname, "err", errs[i])
+			}
+			continue
+		}
+		e.addSpoolDir(queues[i], dirname, contents[i])
+	}
+	for id, message := range e.spool.messages {
+		if !message.seen {
+			delete(e.spool.messages, id)
+		}
+		message.seen = false
+	}
+	return nil
+}
+
+// parallel calls fn with each index from 0 to n-1, running up to --queue.concurrency calls at a time.
+func parallel(n int, fn func(i int)) {
+	workers := *queueConcurrency
+	if workers > n {
+		workers = n
+	}
+	if workers <= 1 {
+		for i := 0; i < n; i++ {
+			fn(i)
+		}
+		return
+	}
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+}
+
+// readSpoolHeader reads the fields of the message header needed by the queue metrics. Whatever could be read from an
+// invalid header is still used.
+func readSpoolHeader(message *SpoolMessage) {
+	header, err := ReadSpoolHeader(message.path)
+	if header == nil {
+		return
+	}
+	message.parsed = true
+	message.invalid = err != nil
+	message.frozen = header.Frozen
+	message.recipients = len(header.Recipients)
+	pending := header.Pending()
+	message.pending = len(pending)
+	message.senderDomain = ""
+	message.recipientDomains = nil
+	if *webQueueAPI {
+		message.sender = header.Sender
+		message.addresses = make([]QueuedRecipient, 0, len(header.Recipients))
+		delivered := make(map[string]bool, len(header.NonRecipients))
+		for _, address := range header.NonRecipients {
+			delivered[address] = true
+		}
+		for _, recipient := range header.Recipients {
+			message.addresses = append(message.addresses, QueuedRecipient{recipient.Address, delivered[recipient.Address]})
+		}
+	}
+	if !message.invalid {
+		message.senderDomain = addressDomain(header.Sender)
+		for _, recipient := range pending {
+			domain := addressDomain(recipient.Address)
+			if domain != "" && !slices.Contains(message.recipientDomains, domain) {
+				message.recipientDomains = append(message.recipientDomains, domain)
+			}
+		}
+	}
+	if info, err := os.Lstat(strings.TrimSuffix(message.path, "-H") + "-D"); err == nil {
+		message.dataSize = info.Size()
+	}
+	message.flags = 0
+	for i, flag := range queueFlags {
+		if flag.isSet(header) {
+			message.flags |= 1 << i
+		}
+	}
+	message.received = header.Received
+}
+
+// dataFileLocked reports whether the data file is locked by a process delivering the message.
+func dataFileLocked(filename string) bool {
+	fh, err := os.Open(filename)
+	if err != nil {
+		return false
+	}
+	defer func() { _ = fh.Close() }()
+	// Exim takes a write lock on the data file while delivering, so it conflicts with a read lock
+	lock := syscall.Flock_t{Type: syscall.F_RDLCK, Whence: io.SeekStart}
+	if err := syscall.FcntlFlock(fh.Fd(), syscall.F_GETLK, &lock); err != nil {
+		return false
+	}
+	return lock.Type != syscall.F_UNLCK
+}
+
+// QueueSize reports the messages in the spool cache. Unless the spool is being watched, the cache is first brought up
+// to date by reading the spool directories. Headers of new or changed messages are read until --queue.read-timeout
+// passes, after which they are left for the next scrape.
+func (e *Exporter) QueueSize() (QueueSize, error) {
+	if *queueCommand != "" {
+		return e.commandQueueSize()
+	}
+	_ = level.Debug(e.logger).Log("msg", "Reading queue size")
+	timeout := *frozenTimeout
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(*frozenTimeout)
+	}
+	queueSize := QueueSize{queues: map[string]*QueueStats{"": newQueueStats()}}
+
+	e.spool.mu.Lock()
+	defer e.spool.mu.Unlock()
+	if !e.spool.watched {
+		if err := e.SyncSpool(); err != nil {
+			return queueSize, err
+		}
+	}
+
+	// Read the new headers first, so they can be read concurrently. Message logs change with every delivery attempt,
+	// so they're checked for every message.
+	unparsed := make([]*SpoolMessage, 0)
+	for _, message := range e.spool.messages {
+		if !message.parsed || *queueReadMsglog {
+			unparsed = append(unparsed, message)
+		}
+	}
+	var timedOut atomic.Bool
+	parallel(len(unparsed), func(i int) {
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			timedOut.Store(true)
+			return
+		}
+		if !unparsed[i].parsed {
+			readSpoolHeader(unparsed[i])
+		}
+		if *queueReadMsglog {
+			e.readMsglog(unparsed[i])
+		}
+	})
+	queueSize.timedOut = timedOut.Load()
+
+	// Locks can't be cached, since they're only held while a message is being delivered
+	var messages []*SpoolMessage
+	var locked []bool
+	if *queueCheckLocks {
+		for _, message := range e.spool.messages {
+			messages = append(messages, message)
+		}
+		locked = make([]bool, len(messages))
+		parallel(len(messages), func(i int) {
+			locked[i] = dataFileLocked(strings.TrimSuffix(messages[i].path, "-H") + "-D")
+		})
+	}
+
+	// Named queues are reported even when they're empty
+	for _, queue := range e.spool.queues {
+		queueSize.queues[queue] = newQueueStats()
+	}
+	for queue, sizes := range e.spool.dirSizes {
+		if stats, ok := queueSize.queues[queue]; ok {
+			// Copied, since the watcher updates the cache after the lock is released
+			stats.directories = maps.Clone(sizes)
+		}
+	}
+	for _, queue := range e.spool.orphanedData {
+		if stats, ok := queueSize.queues[queue]; ok {
+			stats.orphanedData++
+		}
+	}
+
+	now := timeNow()
+	for _, message := range e.spool.messages {
+		stats, ok := queueSize.queues[message.queue]
+		if !ok {
+			stats = newQueueStats()
+			queueSize.queues[message.queue] = stats
+		}
+		stats.total += 1
+		stats.bytes += float64(message.size + message.dataSize)
+		stats.recipients += float64(message.recipients)
+		stats.pending += float64(message.pending)
+		if message.parsed {
+			if message.senderDomain != "" {
+				stats.senderDomains[message.senderDomain]++
+			}
+			for _, domain := range message.recipientDomains {
+				stats.recipientDomains[domain]++
+			}
+		}
+		if message.frozen {
+			stats.frozen++
+		}
+		if message.invalid {
+			stats.invalid++
+		}
+		if message.orphaned {
+			stats.orphanedHeaders++
+		}
+		for i := range queueFlags {
+			if message.flags&(1<<i) != 0 {
+				stats.flags[i]++
+			}
+		}
+		if !message.received.IsZero() {
+			stats.ages.Observe(now.Sub(message.received).Seconds())
+		}
+		if *queueReadMsglog {
+			stats.attempts.Observe(float64(message.attempts))
+			if message.deferReason != "" {
+				stats.deferred[message.deferReason]++
+			}
+		}
+	}
+	for i := range locked {
+		if locked[i] {
+			queueSize.queues[messages[i].queue].locked++
+		}
+	}
+	if queueSize.timedOut {
+		_ = level.Warn(e.logger).Log("msg", "Timed out reading queued message headers, the rest will be read on the next scrape")
+		eximQueueStateTimeoutErrors.Inc()
+	}
+	return queueSize, nil
+}
+
+// QueueScanner makes sure only one scan of the spool runs at a time, and remembers the result of the last one.
+type QueueScanner struct {
+	scanning sync.Mutex
+	mu       sync.Mutex
+	queue    QueueSize
+	// When the last scan finished, and when the last successful scan finished
+	finished time.Time
+	scanned  time.Time
+}
+
+func NewQueueScanner() *QueueScanner {
+	return &QueueScanner{
+		queue:   QueueSize{queues: map[string]*QueueStats{"": newQueueStats()}},
+		scanned: time.Now(),
+	}
+}
+
+// ScanQueue scans the spool and returns the result. If a scan is already in progress, it waits for that scan to finish
+// and returns its result instead of starting another. When a scan fails, the result of the last successful scan is
+// returned.
+func (e *Exporter) ScanQueue() QueueSize {
+	requested := time.Now()
+	e.scanner.scanning.Lock()
+	defer e.scanner.scanning.Unlock()
+	if e.scanner.finished.After(requested) {
+		return e.CachedQueue()
+	}
+
+	start := time.Now()
+	queue, err := e.QueueSize()
+	finished := time.Now()
+	eximQueueScanDuration.Observe(finished.Sub(start).Seconds())
+	if err != nil {
+		_ = level.Error(e.logger).Log("msg", "Unable to read queue", "err", err)
+		eximQueueScanErrors.Inc()
+	}
+
+	e.scanner.mu.Lock()
+	defer e.scanner.mu.Unlock()
+	e.scanner.finished = finished
+	if err == nil {
+		e.scanner.queue = queue
+		e.scanner.scanned = finished
+	}
+	return e.scanner.queue
+}
+
+// CachedQueue returns the result of the last successful scan.
+func (e *Exporter) CachedQueue() QueueSize {
+	e.scanner.mu.Lock()
+	defer e.scanner.mu.Unlock()
+	return e.scanner.queue
+}
+
+// QueueScanAge returns the number of seconds since the last successful scan.
+func (e *Exporter) QueueScanAge() float64 {
+	e.scanner.mu.Lock()
+	defer e.scanner.mu.Unlock()
+	return time.Since(e.scanner.scanned).Seconds()
+}
+
+// RunQueueScanner scans the spool every interval, so scrapes can be served the last result without waiting.
+func (e *Exporter) RunQueueScanner(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		e.ScanQueue()
+	}
+}
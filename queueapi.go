@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+const (
+	queueAPIDefaultLimit = 100
+	queueAPIMaxLimit     = 1000
+)
+
+// QueuedRecipient is a recipient of a queued message, as listed by exim -bp.
+type QueuedRecipient struct {
+	Address   string `json:"address"`
+	Delivered bool   `json:"delivered"`
+}
+
+// QueuedMessage is a message in the listing returned by the queue API.
+type QueuedMessage struct {
+	ID         string            `json:"id"`
+	Queue      string            `json:"queue"`
+	Received   *time.Time        `json:"received,omitempty"`
+	AgeSeconds float64           `json:"age_seconds"`
+	Size       int64             `json:"size"`
+	Sender     string            `json:"sender"`
+	Recipients []QueuedRecipient `json:"recipients"`
+	Frozen     bool              `json:"frozen"`
+	// The header hasn't been read yet, or couldn't be parsed, so the sender and recipients may be missing
+	Incomplete bool `json:"incomplete,omitempty"`
+}
+
+type QueueListing struct {
+	Total    int             `json:"total"`
+	Offset   int             `json:"offset"`
+	Limit    int             `json:"limit"`
+	Messages []QueuedMessage `json:"messages"`
+}
+
+// QueueFilter selects the messages returned by the queue API. Unset fields match every message.
+type QueueFilter struct {
+	Queue     *string
+	Sender    *regexp.Regexp
+	Recipient *regexp.Regexp
+	MinAge    time.Duration
+	MaxAge    time.Duration
+	Frozen    *bool
+	Offset    int
+	Limit     int
+}
+
+// ParseQueueFilter reads a filter from the query parameters of a queue API request.
+func ParseQueueFilter(query map[string][]string) (QueueFilter, error) {
+	filter := QueueFilter{Limit: queueAPIDefaultLimit}
+	get := func(name string) (string, bool) {
+		values, ok := query[name]
+		if !ok || len(values) == 0 {
+			return "", false
+		}
+		return values[0], true
+	}
+	var err error
+	if value, ok := get("queue"); ok {
+		filter.Queue = &value
+	}
+	for name, re := range map[string]**regexp.Regexp{"sender": &filter.Sender, "recipient": &filter.Recipient} {
+		if value, ok := get(name); ok {
+			if *re, err = regexp.Compile(value); err != nil {
+				return filter, fmt.Errorf("invalid %s: %w", name, err)
+			}
+		}
+	}
+	for name, age := range map[string]*time.Duration{"min_age": &filter.MinAge, "max_age": &filter.MaxAge} {
+		if value, ok := get(name); ok {
+			if *age, err = time.ParseDuration(value); err != nil {
+				return filter, fmt.Errorf("invalid %s: %w", name, err)
+			}
+		}
+	}
+	if value, ok := get("frozen"); ok {
+		frozen, err := strconv.ParseBool(value)
+		if err != nil {
+			return filter, fmt.Errorf("invalid frozen: %w", err)
+		}
+		filter.Frozen = &frozen
+	}
+	for name, n := range map[string]*int{"offset": &filter.Offset, "limit": &filter.Limit} {
+		if value, ok := get(name); ok {
+			if *n, err = strconv.Atoi(value); err != nil || *n < 0 {
+				return filter, fmt.Errorf("invalid %s: %q", name, value)
+			}
+		}
+	}
+	if filter.Limit == 0 {
+		return filter, fmt.Errorf("invalid limit: %q", query["limit"][0])
+	}
+	filter.Limit = min(filter.Limit, queueAPIMaxLimit)
+	return filter, nil
+}
+
+func (f QueueFilter) Match(message QueuedMessage) bool {
+	if f.Queue != nil && message.Queue != *f.Queue {
+		return false
+	}
+	if f.Frozen != nil && message.Frozen != *f.Frozen {
+		return false
+	}
+	age := time.Duration(message.AgeSeconds * float64(time.Second))
+	if (f.MinAge > 0 && age < f.MinAge) || (f.MaxAge > 0 && age > f.MaxAge) {
+		return false
+	}
+	if f.Sender != nil && !f.Sender.MatchString(message.Sender) {
+		return false
+	}
+	if f.Recipient != nil {
+		for _, recipient := range message.Recipients {
+			if f.Recipient.MatchString(recipient.Address) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// ListQueue returns the queued messages matching the filter, oldest first, from the spool cache as of the last scan.
+func (e *Exporter) ListQueue(filter QueueFilter) QueueListing {
+	if *queueScanInterval == 0 {
+		e.ScanQueue()
+	}
+	now := timeNow()
+	matched := make([]QueuedMessage, 0)
+	e.spool.mu.Lock()
+	for id, message := range e.spool.messages {
+		queued := QueuedMessage{
+			ID:         id,
+			Queue:      message.queue,
+			Size:       message.size + message.dataSize,
+			Sender:     message.sender,
+			Recipients: message.addresses,
+			Frozen:     message.frozen,
+			Incomplete: !message.parsed || message.invalid,
+		}
+		if !message.received.IsZero() {
+			received := message.received
+			queued.Received = &received
+			queued.AgeSeconds = now.Sub(received).Seconds()
+		}
+		if queued.Recipients == nil {
+			queued.Recipients = []QueuedRecipient{}
+		}
+		if filter.Match(queued) {
+			matched = append(matched, queued)
+		}
+	}
+	e.spool.mu.Unlock()
+
+	sort.Slice(matched, func(i, j int) bool {
+		if matched[i].AgeSeconds != matched[j].AgeSeconds {
+			return matched[i].AgeSeconds > matched[j].AgeSeconds
+		}
+		return matched[i].ID < matched[j].ID
+	})
+	listing := QueueListing{Total: len(matched), Offset: filter.Offset, Limit: filter.Limit, Messages: []QueuedMessage{}}
+	if filter.Offset < len(matched) {
+		listing.Messages = matched[filter.Offset:min(filter.Offset+filter.Limit, len(matched))]
+	}
+	return listing
+}
+
+// ServeQueueAPI lists the queued messages as JSON, filtered by the query parameters.
+func (e *Exporter) ServeQueueAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	filter, err := ParseQueueFilter(r.URL.Query())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	if err := json.NewEncoder(w).Encode(e.ListQueue(filter)); err != nil {
+		_ = level.Error(e.logger).Log("msg", "Unable to write queue listing", "err", err)
+	}
+}
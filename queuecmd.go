@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// A message in exim -bp output: age, size, message ID and sender, followed by *** frozen *** for frozen messages.
+var queueListingRegexp = regexp.MustCompile(`^\s*(\d+)([smhdw])\s+([0-9.]+[KMG]?)\s+(\S+)\s+<(.*?)>(.*)$`)
+
+var queueListingUnits = map[string]float64{"s": 1, "m": 60, "h": 3600, "d": 86400, "w": 604800}
+
+// parseListingSize parses a message size as formatted by exim -bp, such as 512, 2.9K or 12M.
+func parseListingSize(text string) (float64, error) {
+	multiplier := float64(1)
+	for i, suffix := range []string{"K", "M", "G"} {
+		if strings.HasSuffix(text, suffix) {
+			text = strings.TrimSuffix(text, suffix)
+			multiplier = float64(uint64(1) << (10 * (i + 1)))
+		}
+	}
+	size, err := strconv.ParseFloat(text, 64)
+	return size * multiplier, err
+}
+
+// ParseQueueListing reads the output of exim -bp, or the message count printed by exim -bpc. Ages and sizes are only
+// as precise as exim prints them, and a count only gives the number of messages.
+func ParseQueueListing(r io.Reader) (*QueueStats, error) {
+	stats := newQueueStats()
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	lineNumber := 0
+	inMessage := false
+	// Domains of the current message's pending recipients, since messages are counted once per domain
+	var messageDomains map[string]bool
+	for scanner.Scan() {
+		lineNumber++
+		line := scanner.Text()
+		text := strings.TrimSpace(line)
+		if text == "" {
+			inMessage = false
+			continue
+		}
+		if count, err := strconv.Atoi(text); err == nil && lineNumber == 1 {
+			// exim -bpc
+			stats.total = float64(count)
+			continue
+		}
+		if match := queueListingRegexp.FindStringSubmatch(line); match != nil {
+			age, _ := strconv.ParseFloat(match[1], 64)
+			size, err := parseListingSize(match[3])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid size %q", lineNumber, match[3])
+			}
+			stats.total++
+			stats.bytes += size
+			stats.ages.Observe(age * queueListingUnits[match[2]])
+			if strings.Contains(match[6], "*** frozen ***") {
+				stats.frozen++
+			}
+			if strings.Contains(match[6], "*** spool") {
+				stats.invalid++
+			}
+			stats.senderDomains[addressDomain(match[5])]++
+			inMessage = true
+			messageDomains = make(map[string]bool)
+			continue
+		}
+		if !inMessage {
+			return nil, fmt.Errorf("line %d: unexpected %q", lineNumber, text)
+		}
+		// Recipients follow the message, with delivered ones marked D, or +D for addresses generated from them
+		stats.recipients++
+		if strings.HasPrefix(text, "D ") || strings.HasPrefix(text, "+D ") {
+			continue
+		}
+		stats.pending++
+		if domain := addressDomain(text); domain != "" && !messageDomains[domain] {
+			messageDomains[domain] = true
+			stats.recipientDomains[domain]++
+		}
+	}
+	return stats, scanner.Err()
+}
+
+// How long to wait for the output of a queue command to be closed once it has been killed.
+const queueCommandWaitDelay = 100 * time.Millisecond
+
+// commandQueueSize runs --queue.command instead of reading the spool, for when the exporter isn't allowed to read the
+// spool directories but can run exim, or a wrapper such as sudo. The command is killed after --queue.read-timeout.
+func (e *Exporter) commandQueueSize() (QueueSize, error) {
+	_ = level.Debug(e.logger).Log("msg", "Running queue command", "command", *queueCommand)
+	queueSize := QueueSize{queues: map[string]*QueueStats{"": newQueueStats()}}
+	args := strings.Fields(*queueCommand)
+	ctx := context.Background()
+	if *frozenTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *frozenTimeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	// Wrappers such as sudo run exim as a child of their own, so the whole process group is killed on timeout.
+	// Children which leave it can still hold stdout open, so output isn't waited for long after that.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = queueCommandWaitDelay
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		eximQueueStateTimeoutErrors.Inc()
+		return queueSize, fmt.Errorf("queue command timed out after %s", *frozenTimeout)
+	}
+	if err != nil {
+		return queueSize, fmt.Errorf("queue command failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	stats, err := ParseQueueListing(bytes.NewReader(output))
+	if err != nil {
+		return queueSize, fmt.Errorf("unable to parse queue command output: %w", err)
+	}
+	queueSize.queues[""] = stats
+	return queueSize, nil
+}
@@ -0,0 +1,461 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SpoolHeader is the content of a message's -H file.
+// https://www.exim.org/exim-html-current/doc/html/spec_html/ch-format_of_spool_files.html
+type SpoolHeader struct {
+	ID string
+	// The login of the user who submitted the message, with their uid and gid
+	Login string
+	UID   int
+	GID   int
+	// The envelope sender, which is empty for bounces
+	Sender       string
+	Received     time.Time
+	WarningCount int
+
+	// Every variable line (-name or -name value), with the leading hyphens removed. Variables set to a tainted value
+	// are written with two hyphens, and recorded in Tainted.
+	Variables map[string]string
+	Tainted   map[string]bool
+	// ACL variables, keyed by name (c0, mfoo, etc)
+	ACLVariables map[string]string
+
+	// Commonly used variables
+	Frozen           bool
+	FrozenAt         time.Time
+	ManualThaw       bool
+	LocalError       bool
+	DeliverFirstTime bool
+	NoDelivery       bool
+	HostAddress      string
+	HostAuth         string
+	TLSCipher        string
+	ReceivedProtocol string
+	BodyLineCount    int
+
+	// Addresses which have already been delivered to, or are otherwise not to be delivered to
+	NonRecipients []string
+	Recipients    []SpoolRecipient
+	Headers       []SpoolHeaderLine
+}
+
+type SpoolRecipient struct {
+	Address string
+	// Set by the errors_to router option
+	ErrorsTo string
+	// The original recipient, and the DSN NOTIFY options given with RCPT TO
+	ORcpt    string
+	DSNFlags int
+	// The parent of an address generated by one_time redirection, or -1
+	Parent int
+}
+
+type SpoolHeaderLine struct {
+	// Identifies headers which Exim makes use of, such as 'F' for From: or 'R' for Received:. Other headers have a
+	// space, and deleted headers have '*'.
+	Type byte
+	// The complete header, including its name and trailing newline
+	Text string
+	// The length written before the header didn't match it, so it was taken to end at the next line which isn't
+	// indented instead
+	Mismatched bool
+}
+
+// Pending returns the recipients which haven't been delivered to yet.
+func (h *SpoolHeader) Pending() []SpoolRecipient {
+	done := make(map[string]bool, len(h.NonRecipients))
+	for _, address := range h.NonRecipients {
+		done[address] = true
+	}
+	pending := make([]SpoolRecipient, 0, len(h.Recipients))
+	for _, recipient := range h.Recipients {
+		if !done[recipient.Address] {
+			pending = append(pending, recipient)
+		}
+	}
+	return pending
+}
+
+// ReadSpoolHeader parses the -H file of a queued message.
+func ReadSpoolHeader(filename string) (*SpoolHeader, error) {
+	fh, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = fh.Close() }()
+	return ParseSpoolHeader(fh)
+}
+
+// ParseSpoolHeader parses a spool header. If the header is invalid, the fields read before the problem was found are
+// returned along with the error.
+func ParseSpoolHeader(r io.Reader) (*SpoolHeader, error) {
+	p := &spoolParser{reader: bufio.NewReader(r)}
+	header := &SpoolHeader{
+		Variables:    make(map[string]string),
+		Tainted:      make(map[string]bool),
+		ACLVariables: make(map[string]string),
+	}
+	err := p.parse(header)
+	if err != nil {
+		err = fmt.Errorf("line %d: %w", p.line, err)
+	}
+	return header, err
+}
+
+type spoolParser struct {
+	reader *bufio.Reader
+	line   int
+}
+
+// readLine returns the next line without its newline.
+func (p *spoolParser) readLine() (string, error) {
+	text, err := p.reader.ReadString('\n')
+	if err == io.EOF {
+		if text == "" {
+			return "", io.ErrUnexpectedEOF
+		}
+		err = nil
+	}
+	p.line++
+	return strings.TrimSuffix(text, "\n"), err
+}
+
+func (p *spoolParser) parse(header *SpoolHeader) error {
+	// The first line is the name of the file
+	text, err := p.readLine()
+	if err != nil {
+		return err
+	}
+	if !strings.HasSuffix(text, "-H") {
+		return fmt.Errorf("invalid file name %q", text)
+	}
+	header.ID = strings.TrimSuffix(text, "-H")
+
+	text, err = p.readLine()
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(text)
+	if len(fields) != 3 {
+		return fmt.Errorf("invalid user %q", text)
+	}
+	header.Login = fields[0]
+	if header.UID, err = strconv.Atoi(fields[1]); err != nil {
+		return fmt.Errorf("invalid uid %q", fields[1])
+	}
+	if header.GID, err = strconv.Atoi(fields[2]); err != nil {
+		return fmt.Errorf("invalid gid %q", fields[2])
+	}
+
+	text, err = p.readLine()
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(text, "<") || !strings.HasSuffix(text, ">") {
+		return fmt.Errorf("invalid sender %q", text)
+	}
+	header.Sender = text[1 : len(text)-1]
+
+	text, err = p.readLine()
+	if err != nil {
+		return err
+	}
+	fields = strings.Fields(text)
+	if len(fields) != 2 {
+		return fmt.Errorf("invalid received time %q", text)
+	}
+	received, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid received time %q", fields[0])
+	}
+	header.Received = time.Unix(received, 0)
+	if header.WarningCount, err = strconv.Atoi(fields[1]); err != nil {
+		return fmt.Errorf("invalid warning count %q", fields[1])
+	}
+
+	// Variables, until the first line not starting with a hyphen, which begins the non-recipients tree
+	for {
+		text, err = p.readLine()
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(text, "-") {
+			break
+		}
+		if err := p.parseVariable(header, text); err != nil {
+			return err
+		}
+	}
+
+	if text != "XX" {
+		if err := p.parseTree(header, text); err != nil {
+			return err
+		}
+	}
+
+	text, err = p.readLine()
+	if err != nil {
+		return err
+	}
+	count, err := strconv.Atoi(text)
+	if err != nil || count < 0 {
+		return fmt.Errorf("invalid recipient count %q", text)
+	}
+	header.Recipients = make([]SpoolRecipient, 0, count)
+	for i := 0; i < count; i++ {
+		text, err = p.readLine()
+		if err != nil {
+			return err
+		}
+		recipient, err := parseRecipient(text)
+		if err != nil {
+			return err
+		}
+		header.Recipients = append(header.Recipients, recipient)
+	}
+
+	// A blank line separates the recipients from the headers
+	text, err = p.readLine()
+	if err != nil {
+		return err
+	}
+	if text != "" {
+		return fmt.Errorf("expected a blank line after the recipients, found %q", text)
+	}
+	data, err := io.ReadAll(p.reader)
+	if err != nil {
+		return err
+	}
+	for len(data) > 0 {
+		line, n, err := p.parseHeaderLine(data)
+		if err != nil {
+			return err
+		}
+		header.Headers = append(header.Headers, line)
+		data = data[n:]
+	}
+	return nil
+}
+
+func (p *spoolParser) parseVariable(header *SpoolHeader, text string) error {
+	name, value, _ := strings.Cut(text[1:], " ")
+	tainted := false
+	if strings.HasPrefix(name, "-") {
+		name = name[1:]
+		tainted = true
+	}
+
+	// ACL variables can contain newlines, so the length of the value is given and the value follows on the next lines
+	if name == "aclc" || name == "aclm" {
+		aclName, length, _ := strings.Cut(value, " ")
+		n, err := strconv.Atoi(length)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid ACL variable %q", text)
+		}
+		data := make([]byte, n+1)
+		if _, err := io.ReadFull(p.reader, data); err != nil {
+			return io.ErrUnexpectedEOF
+		}
+		p.line += strings.Count(string(data), "\n")
+		header.ACLVariables[name[3:]+aclName] = string(data[:n])
+		return nil
+	}
+
+	header.Variables[name] = value
+	if tainted {
+		header.Tainted[name] = true
+	}
+	switch name {
+	case "frozen":
+		header.Frozen = true
+		if frozen, err := strconv.ParseInt(value, 10, 64); err == nil {
+			header.FrozenAt = time.Unix(frozen, 0)
+		}
+	case "manual_thaw":
+		header.ManualThaw = true
+	case "localerror":
+		header.LocalError = true
+	case "deliver_firsttime":
+		header.DeliverFirstTime = true
+	case "N":
+		header.NoDelivery = true
+	case "host_address":
+		header.HostAddress = value
+	case "host_auth":
+		header.HostAuth = value
+	case "tls_cipher":
+		header.TLSCipher = value
+	case "received_protocol":
+		header.ReceivedProtocol = value
+	case "body_linecount":
+		header.BodyLineCount, _ = strconv.Atoi(value)
+	case "received_time_usec":
+		// The fraction of a second the message was received at, such as .380417
+		if usec, err := strconv.Atoi(strings.TrimPrefix(value, ".")); err == nil {
+			header.Received = header.Received.Add(time.Duration(usec) * time.Microsecond)
+		}
+	}
+	return nil
+}
+
+// parseTree reads the non-recipients tree. Each node is written as two letters, Y or N, saying whether it has a left
+// and right subtree, followed by the address, and the subtrees follow in preorder.
+func (p *spoolParser) parseTree(header *SpoolHeader, text string) error {
+	if len(text) < 3 || text[2] != ' ' {
+		return fmt.Errorf("invalid non-recipients tree node %q", text)
+	}
+	header.NonRecipients = append(header.NonRecipients, text[3:])
+	for _, child := range text[:2] {
+		switch child {
+		case 'N':
+		case 'Y':
+			next, err := p.readLine()
+			if err != nil {
+				return err
+			}
+			if err := p.parseTree(header, next); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("invalid non-recipients tree node %q", text)
+		}
+	}
+	return nil
+}
+
+// parseRecipient reads a recipient, which is either a plain address, or has extra data appended and ends with # and
+// flags saying what is present: 1 for errors_to and the one_time parent, and 2 for the DSN original recipient and
+// flags. Each of those is written as the value, a space, then its length and a number separated by a comma, so they
+// are read from the end of the line.
+func parseRecipient(text string) (SpoolRecipient, error) {
+	recipient := SpoolRecipient{Address: text, Parent: -1}
+	hash := strings.LastIndexByte(text, '#')
+	if hash < 0 {
+		return recipient, nil
+	}
+	flags, err := strconv.Atoi(text[hash+1:])
+	if err != nil {
+		// Part of the address
+		return recipient, nil
+	}
+	rest := text[:hash]
+	if flags&1 != 0 {
+		var value string
+		if value, recipient.Parent, rest, err = cutRecipientData(rest); err != nil {
+			return recipient, fmt.Errorf("invalid recipient %q: %w", text, err)
+		}
+		recipient.ErrorsTo = value
+	}
+	if flags&2 != 0 {
+		var value string
+		if value, recipient.DSNFlags, rest, err = cutRecipientData(rest); err != nil {
+			return recipient, fmt.Errorf("invalid recipient %q: %w", text, err)
+		}
+		recipient.ORcpt = value
+	}
+	recipient.Address = rest
+	return recipient, nil
+}
+
+// cutRecipientData removes "<value> <length>,<number>" from the end of text.
+func cutRecipientData(text string) (string, int, string, error) {
+	space := strings.LastIndexByte(text, ' ')
+	if space < 0 {
+		return "", 0, "", errors.New("missing length")
+	}
+	lengthText, numberText, ok := strings.Cut(text[space+1:], ",")
+	if !ok {
+		return "", 0, "", errors.New("missing length")
+	}
+	length, err := strconv.Atoi(lengthText)
+	if err != nil || length < 0 || length > space {
+		return "", 0, "", fmt.Errorf("invalid length %q", lengthText)
+	}
+	number, err := strconv.Atoi(numberText)
+	if err != nil {
+		return "", 0, "", fmt.Errorf("invalid number %q", numberText)
+	}
+	value := text[space-length : space]
+	rest := text[:space-length]
+	// The value is preceded by a space, which separates it from the address
+	if !strings.HasSuffix(rest, " ") {
+		return "", 0, "", errors.New("missing separator")
+	}
+	return value, number, rest[:len(rest)-1], nil
+}
+
+// parseHeaderLine parses the header at the start of data, written as its length, type and a space, followed by the
+// header itself, which may span several lines. It returns the header and the number of bytes it took up.
+//
+// Exim reads headers by their length, so a length which doesn't end the header at the end of a line followed by the
+// next header means the file was edited by hand (or, without a newline at the end of the file, truncated). Rather
+// than reading the rest of the headers out of step, the header is taken to end before the next line which isn't
+// indented, and marked as Mismatched. The message itself is still valid.
+func (p *spoolParser) parseHeaderLine(data []byte) (SpoolHeaderLine, int, error) {
+	p.line++
+	digits := 0
+	for digits < len(data) && isDigit(data[digits]) {
+		digits++
+	}
+	if digits+2 > len(data) {
+		return SpoolHeaderLine{}, 0, io.ErrUnexpectedEOF
+	}
+	if digits == 0 || data[digits+1] != ' ' {
+		return SpoolHeaderLine{}, 0, fmt.Errorf("invalid header %q", data[:digits+2])
+	}
+	length, err := strconv.Atoi(string(data[:digits]))
+	if err != nil || length == 0 {
+		return SpoolHeaderLine{}, 0, fmt.Errorf("invalid header length %q", data[:digits])
+	}
+	line := SpoolHeaderLine{Type: data[digits]}
+	start := digits + 2
+	end := start + length
+	switch {
+	case end <= len(data) && data[end-1] == '\n' && (end == len(data) || isDigit(data[end])):
+		line.Text = string(data[start:end])
+	case end == len(data)+1 && data[len(data)-1] != '\n':
+		// Tolerate a missing newline at the end of the file
+		end = len(data)
+		line.Text = string(data[start:end]) + "\n"
+	default:
+		end = headerEnd(data, start)
+		line.Text = string(data[start:end])
+		if !strings.HasSuffix(line.Text, "\n") {
+			line.Text += "\n"
+		}
+		line.Mismatched = true
+	}
+	p.line += strings.Count(line.Text, "\n") - 1
+	return line, end, nil
+}
+
+// headerEnd returns the end of the header starting at start, which is continued by lines starting with whitespace.
+func headerEnd(data []byte, start int) int {
+	end := start
+	for {
+		newline := bytes.IndexByte(data[end:], '\n')
+		if newline < 0 {
+			return len(data)
+		}
+		end += newline + 1
+		if end == len(data) || (data[end] != ' ' && data[end] != '\t') {
+			return end
+		}
+	}
+}
+
+func isDigit(b byte) bool {
+	return b >= '0' && b <= '9'
+}
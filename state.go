@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Bump stateVersion whenever the meaning of a persisted counter changes. Files written by another version are ignored.
+const stateVersion = 1
+
+type persistedCounter struct {
+	collector prometheus.Collector
+	labels    []string
+}
+
+// The counters derived from the logs, which are saved to the state file so their totals survive restarts.
+var persistedCounters = map[string]persistedCounter{
+	"exim_messages_total":       {eximMessages, []string{"flag"}},
+	"exim_message_errors_total": {eximMessageErrors, []string{"status", "enhanced"}},
+	"exim_reject_total":         {eximReject, []string{}},
+	"exim_panic_total":          {eximPanic, []string{}},
+}
+
+type counterState struct {
+	Version  int                      `json:"version"`
+	Time     time.Time                `json:"time"`
+	Counters map[string]counterFamily `json:"counters"`
+	// The log read positions at the time the counters were saved, when checkpointing is enabled
+	Checkpoint *checkpointPositions `json:"checkpoint,omitempty"`
+}
+
+type counterFamily struct {
+	Labels  []string        `json:"labels"`
+	Samples []counterSample `json:"samples"`
+}
+
+type counterSample struct {
+	Labels map[string]string `json:"labels"`
+	Value  float64           `json:"value"`
+}
+
+// CounterStore saves the values of the log derived counters to a state file, and restores them at startup.
+// A nil *CounterStore is valid and disables persistence.
+//
+// The checkpoint is saved to its own file more often than the counters, so after a crash, the positions in it would
+// be ahead of the saved counters, and the lines in between never counted. Instead, the positions taken along with the
+// counters are saved in the state file too, and restored in place of those in the checkpoint file.
+type CounterStore struct {
+	filename   string
+	logger     log.Logger
+	counters   map[string]persistedCounter
+	checkpoint *Checkpoint
+}
+
+// NewCounterStore returns a store for the counters, and the positions in checkpoint, which may be nil.
+func NewCounterStore(filename string, logger log.Logger, checkpoint *Checkpoint) *CounterStore {
+	return &CounterStore{filename, logger, persistedCounters, checkpoint}
+}
+
+// Restore adds the saved values to the counters, and restores the positions they were saved at. It must be called
+// before any logs are read.
+func (s *CounterStore) Restore() {
+	if s == nil {
+		return
+	}
+	data, err := os.ReadFile(s.filename)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		_ = level.Warn(s.logger).Log("msg", "Unable to read state file, counters start from zero", "err", err)
+		return
+	}
+	var state counterState
+	if err := json.Unmarshal(data, &state); err != nil {
+		_ = level.Warn(s.logger).Log("msg", "Unable to parse state file, counters start from zero", "err", err)
+		return
+	}
+	if state.Version != stateVersion {
+		_ = level.Warn(s.logger).Log("msg", "Ignoring state file written by an incompatible version", "version", state.Version)
+		return
+	}
+	for name, family := range state.Counters {
+		counter, ok := s.counters[name]
+		if !ok {
+			_ = level.Warn(s.logger).Log("msg", "Ignoring unknown counter in state file", "name", name)
+			continue
+		}
+		if !reflect.DeepEqual(family.Labels, counter.labels) {
+			_ = level.Warn(s.logger).Log("msg", "Ignoring counter with different labels in state file", "name", name)
+			continue
+		}
+		for _, sample := range family.Samples {
+			if len(sample.Labels) != len(counter.labels) || sample.Value < 0 {
+				continue
+			}
+			switch c := counter.collector.(type) {
+			case *prometheus.CounterVec:
+				m, err := c.GetMetricWith(sample.Labels)
+				if err != nil {
+					continue
+				}
+				m.Add(sample.Value)
+			case prometheus.Counter:
+				c.Add(sample.Value)
+			}
+		}
+	}
+	if s.checkpoint != nil && state.Checkpoint != nil {
+		s.checkpoint.restorePositions(state.Checkpoint)
+		_ = level.Info(s.logger).Log("msg", "Restored counters and log positions from state file", "saved", state.Time)
+		return
+	}
+	_ = level.Info(s.logger).Log("msg", "Restored counters from state file", "saved", state.Time)
+}
+
+func (s *CounterStore) Save() {
+	if s == nil {
+		return
+	}
+	state := counterState{
+		Version:  stateVersion,
+		Time:     time.Now(),
+		Counters: make(map[string]counterFamily),
+	}
+	// Holding the checkpoint lock stops the logs being read while the counters are gathered, so both are taken at the
+	// same point. Only a line being handed to its parser at that moment can end up counted twice or not at all.
+	if s.checkpoint != nil {
+		s.checkpoint.mu.Lock()
+		state.Checkpoint = s.checkpoint.positions()
+	}
+	for name, counter := range s.counters {
+		family := counterFamily{Labels: counter.labels, Samples: []counterSample{}}
+		ch := make(chan prometheus.Metric)
+		go func() {
+			counter.collector.Collect(ch)
+			close(ch)
+		}()
+		for metric := range ch {
+			var m dto.Metric
+			if err := metric.Write(&m); err != nil || m.Counter == nil {
+				continue
+			}
+			labels := make(map[string]string)
+			for _, pair := range m.Label {
+				labels[pair.GetName()] = pair.GetValue()
+			}
+			family.Samples = append(family.Samples, counterSample{labels, m.Counter.GetValue()})
+		}
+		state.Counters[name] = family
+	}
+	if s.checkpoint != nil {
+		s.checkpoint.mu.Unlock()
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		_ = level.Error(s.logger).Log("msg", "Unable to encode state", "err", err)
+		return
+	}
+	tmp := s.filename + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		_ = level.Error(s.logger).Log("msg", "Unable to write state file", "err", err)
+		return
+	}
+	if err := os.Rename(tmp, s.filename); err != nil {
+		_ = level.Error(s.logger).Log("msg", "Unable to write state file", "err", err)
+	}
+}
+
+// Run saves the counters every interval.
+func (s *CounterStore) Run(interval time.Duration) {
+	if s == nil {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.Save()
+	}
+}
@@ -0,0 +1,73 @@
+/*
+ * Writes the retry hints database fixtures with the libraries Exim is built against: Berkeley DB 5.3 (as on Debian,
+ * through its ndbm interface, which creates the same hash database) and GDBM. The records are laid out as Exim's
+ * dbdata_retry on a 64-bit little endian host, with the terminating NUL included in the keys.
+ *
+ *   cc -o mkretrydb mkretrydb.c -l:libdb-5.3.so -l:libgdbm.so.6 && ./mkretrydb
+ */
+#include <fcntl.h>
+#include <stdint.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <unistd.h>
+
+typedef struct { char *dptr; int dsize; } datum;
+
+void *__db_ndbm_open(const char *file, int oflags, int mode);
+int __db_ndbm_store(void *db, datum key, datum data, int flags);
+void __db_ndbm_close(void *db);
+
+void *gdbm_open(const char *name, int block_size, int flags, int mode, void (*fatal)(const char *));
+int gdbm_store(void *db, datum key, datum content, int flag);
+int gdbm_close(void *db);
+
+typedef struct {
+  int64_t time_stamp;
+  int basic_errno;
+  int more_errno;
+  int expired;
+  int64_t first_failed;
+  int64_t last_try;
+  int64_t next_try;
+  char text[];
+} dbdata_retry;
+
+static datum retry(int64_t first_failed, const char *text) {
+  size_t size = sizeof(dbdata_retry) + strlen(text) + 1;
+  dbdata_retry *r = calloc(1, size);
+  r->time_stamp = first_failed + 1200;
+  r->basic_errno = 111;
+  r->first_failed = first_failed;
+  r->last_try = first_failed + 600;
+  r->next_try = first_failed + 1200;
+  strcpy(r->text, text);
+  return (datum){(char *)r, (int)size};
+}
+
+static datum key(const char *k) { return (datum){(char *)k, (int)strlen(k) + 1}; }
+
+int main(void) {
+  /* Long enough to be stored on an overflow page */
+  char long_text[1501];
+  memset(long_text, 'x', 1500);
+  long_text[1500] = 0;
+  datum keys[] = {key("T:mx.mail.bogus:192.0.2.1"), key("R:mail.bogus"), key("T:mx2.mail.bogus:192.0.2.2:1ra7OS-004XaW-CD")};
+  datum values[] = {retry(1707800000, "Connection refused"), retry(1707890000, "host lookup did not complete"),
+                    retry(1707850000, long_text)};
+
+  unlink("retry-bdb.db");
+  void *db = __db_ndbm_open("retry-bdb", O_RDWR | O_CREAT, 0644);
+  if (!db) return 1;
+  for (int i = 0; i < 3; i++)
+    if (__db_ndbm_store(db, keys[i], values[i], 1) != 0) return 1;
+  __db_ndbm_close(db);
+
+  unlink("retry-gdbm");
+  void *gdbm = gdbm_open("retry-gdbm", 0, 3, 0644, NULL);
+  if (!gdbm) return 1;
+  for (int i = 0; i < 3; i++)
+    if (gdbm_store(gdbm, keys[i], values[i], 1) != 0) return 1;
+  gdbm_close(gdbm);
+  return 0;
+}
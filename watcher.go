@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/go-kit/kit/log/level"
+)
+
+// WatchSpool keeps the spool cache up to date using inotify, so scrapes don't need to read the spool directories.
+// Since events can be lost, for example when the kernel queue overflows, the spool is still read in full every
+// resync interval to reconcile the cache. Named queues created since the last resync are watched from the next one.
+func (e *Exporter) WatchSpool(resync time.Duration) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(e.inputPath); err != nil {
+		_ = watcher.Close()
+		return err
+	}
+
+	e.spool.mu.Lock()
+	err = e.SyncSpool()
+	if err == nil {
+		e.spool.watched = true
+	}
+	e.spool.mu.Unlock()
+	if err != nil {
+		_ = watcher.Close()
+		return err
+	}
+	e.watchQueues(watcher)
+
+	go func() {
+		ticker := time.NewTicker(resync)
+		defer ticker.Stop()
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				e.handleSpoolEvent(watcher, event)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				_ = level.Warn(e.logger).Log("msg", "Error watching spool, reading it in full", "err", err)
+				e.resyncSpool(watcher)
+			case <-ticker.C:
+				e.resyncSpool(watcher)
+			}
+		}
+	}()
+	return nil
+}
+
+// watchQueues adds watches for the input and hash directories of every known queue. Directories already being watched
+// are unaffected.
+func (e *Exporter) watchQueues(watcher *fsnotify.Watcher) {
+	e.spool.mu.Lock()
+	queues := append([]string{""}, e.spool.queues...)
+	e.spool.mu.Unlock()
+	for _, queue := range queues {
+		for _, dirname := range e.queueDirs(queue) {
+			// Hash directories only exist once exim has queued a message in them, so missing ones are watched once
+			// they are created.
+			if err := watcher.Add(dirname); err != nil && !errors.Is(err, os.ErrNotExist) {
+				_ = level.Warn(e.logger).Log("msg", "Unable to watch spool directory", "path", dirname, "err", err)
+			}
+		}
+	}
+}
+
+func (e *Exporter) resyncSpool(watcher *fsnotify.Watcher) {
+	_ = level.Debug(e.logger).Log("msg", "Reconciling watched spool")
+	e.spool.mu.Lock()
+	err := e.SyncSpool()
+	e.spool.mu.Unlock()
+	if err != nil {
+		_ = level.Error(e.logger).Log("msg", "Unable to read queue", "err", err)
+		eximQueueScanErrors.Inc()
+		return
+	}
+	e.watchQueues(watcher)
+}
+
+// handleSpoolEvent applies a change to the spool directories to the cache. Exim writes headers to a temporary file and
+// renames it into place, so the header files appear as created, and disappear as removed or renamed. Every entry is
+// counted towards the size of its directory, including the temporary files. A header renamed over one already in the
+// cache replaces it, so it isn't counted again.
+func (e *Exporter) handleSpoolEvent(watcher *fsnotify.Watcher, event fsnotify.Event) {
+	created := event.Has(fsnotify.Create)
+	removed := event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename)
+	if !created && !removed && !event.Has(fsnotify.Write) {
+		return
+	}
+	dirname, fileName := filepath.Dir(event.Name), filepath.Base(event.Name)
+	queue, input := e.inputQueue(dirname)
+	if !input {
+		// Split spool hash directory
+		var ok bool
+		if queue, ok = e.inputQueue(filepath.Dir(dirname)); !ok {
+			return
+		}
+	}
+	e.spool.mu.Lock()
+	defer e.spool.mu.Unlock()
+	if created {
+		if id, ok := headerMessageID(fileName); ok {
+			if message, ok := e.spool.messages[id]; ok && message.path == event.Name {
+				created = false
+			}
+		}
+	}
+	if created {
+		e.countSpoolEntry(queue, dirname, 1)
+	} else if removed {
+		e.countSpoolEntry(queue, dirname, -1)
+	}
+
+	if input && len(fileName) == 1 {
+		if removed {
+			delete(e.spool.dirSizes[queue], fileName)
+			return
+		}
+		if info, err := os.Lstat(event.Name); created && err == nil && info.IsDir() {
+			if err := watcher.Add(event.Name); err != nil {
+				_ = level.Warn(e.logger).Log("msg", "Unable to watch spool directory", "path", event.Name, "err", err)
+			}
+			// Messages may have been queued before the watch was added
+			if err := e.ScanSpoolDir(queue, event.Name); err != nil {
+				_ = level.Warn(e.logger).Log("msg", "Unable to read spool directory", "path", event.Name, "err", err)
+			}
+		}
+		return
+	}
+	if id, ok := spoolMessageID(fileName, "-D"); ok {
+		if created || removed {
+			e.checkOrphaned(queue, dirname, id)
+		}
+		return
+	}
+	id, ok := headerMessageID(fileName)
+	if !ok {
+		return
+	}
+	if removed {
+		if message, ok := e.spool.messages[id]; ok && message.path == event.Name {
+			delete(e.spool.messages, id)
+		}
+	} else if info, err := os.Lstat(event.Name); err == nil {
+		e.spool.Update(id, queue, event.Name, info)
+	}
+	e.checkOrphaned(queue, dirname, id)
+}
+
+// countSpoolEntry adds delta to the number of entries in a spool directory. Directories the spool hasn't been read
+// from yet are left for the next resync. The caller must hold the lock.
+func (e *Exporter) countSpoolEntry(queue, dirname string, delta float64) {
+	rel, err := filepath.Rel(e.queueInputPath(queue), dirname)
+	if err != nil {
+		return
+	}
+	if size, ok := e.spool.dirSizes[queue][rel]; ok {
+		e.spool.dirSizes[queue][rel] = max(size+delta, 0)
+	}
+}
+
+// checkOrphaned works out whether the header or data file of a message is missing, after either was created or
+// removed. The caller must hold the lock.
+func (e *Exporter) checkOrphaned(queue, dirname, id string) {
+	header, data := filepath.Join(dirname, id+"-H"), filepath.Join(dirname, id+"-D")
+	_, headerErr := os.Lstat(header)
+	_, dataErr := os.Lstat(data)
+	if message, ok := e.spool.messages[id]; ok && message.path == header {
+		message.orphaned = dataErr != nil
+	}
+	if dataErr == nil && headerErr != nil {
+		e.spool.orphanedData[data] = queue
+	} else {
+		delete(e.spool.orphanedData, data)
+	}
+}